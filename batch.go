@@ -0,0 +1,148 @@
+package kitty
+
+import "time"
+
+// Limits on what a server can make us hold on to
+const (
+	// Open batches, the oldest is dropped to make room
+	maxOpenBatches = 64
+	// Messages kept per batch, see Batch.Truncated
+	maxBatchMessages = 10000
+	// Batches that haven't ended after this long are dropped
+	batchExpiry = 10 * time.Minute
+)
+
+// Batch is a completed IRCv3 batch, like a netsplit or chathistory playback
+type Batch struct {
+	// Reference from the BATCH line
+	Ref string
+	// Type, like "netsplit", "netjoin" or "chathistory"
+	Type string
+	// Parameters after the type
+	Params []string
+	// Messages in the batch, in order, without nested batches
+	Messages []*Message
+	// Nested batches, in the order they ended
+	Batches []*Batch
+	// Set if the batch had more messages than we keep
+	Truncated bool
+
+	parent  *Batch
+	grouped bool
+	// Messages are only kept if someone is going to look at them
+	collect bool
+	opened  time.Time
+}
+
+// batchTrigger hands completed batches of one type to action
+type batchTrigger struct {
+	batchType string
+	action    func(*Bot, *Batch)
+}
+
+func (t batchTrigger) Handle(bot *Bot, m *Message) {
+	if m.Completed != nil && (t.batchType == "" || m.Completed.Type == t.batchType) {
+		t.action(bot, m.Completed)
+	}
+}
+
+// AddBatchTrigger adds a trigger that gets whole batches of the given type,
+// an empty type gets every batch. It runs when the batch ends,
+// nested batches arrive in Batch.Batches of their parent
+func (bot *Bot) AddBatchTrigger(batchType string, action func(*Bot, *Batch)) TriggerID {
+	return bot.AddTrigger(batchTrigger{batchType: batchType, action: action})
+}
+
+// trackBatch follows BATCH +/- and fills in the batch fields of the message
+func (bot *Bot) trackBatch(m *Message) {
+	ref, _ := m.GetTag("batch")
+	parent := bot.batches[ref]
+	if ref != "" {
+		m.BatchRef = ref
+	}
+	if parent != nil {
+		m.BatchType = parent.Type
+		m.grouped = parent.grouped
+	}
+	if m.Command == "BATCH" && len(m.Params) > 0 && len(m.Params[0]) > 1 {
+		switch m.Params[0][0] {
+		case '+':
+			if len(m.Params) < 2 {
+				return
+			}
+			b := &Batch{
+				Ref:    m.Params[0][1:],
+				Type:   m.Params[1],
+				Params: m.Params[2:],
+				parent: parent,
+				opened: time.Now(),
+			}
+			b.grouped = parent != nil && parent.grouped || bot.groupBatch(b.Type)
+			label, _ := m.GetTag("label")
+			b.collect = parent != nil && parent.collect || b.grouped ||
+				bot.batchWanted(b.Type) || label != "" && bot.requests.waiting(label)
+			bot.expireBatches()
+			bot.batches[b.Ref] = b
+			return
+		case '-':
+			b, ok := bot.batches[m.Params[0][1:]]
+			if !ok {
+				return
+			}
+			delete(bot.batches, b.Ref)
+			if b.parent != nil {
+				if b.parent.collect {
+					b.parent.Batches = append(b.parent.Batches, b)
+				}
+				return
+			}
+			m.Completed = b
+			return
+		}
+	}
+	if parent == nil || !parent.collect {
+		return
+	}
+	if len(parent.Messages) >= maxBatchMessages {
+		parent.Truncated = true
+		return
+	}
+	parent.Messages = append(parent.Messages, m)
+}
+
+// expireBatches drops batches the server never ended
+// and makes room for one more
+func (bot *Bot) expireBatches() {
+	var oldest *Batch
+	for ref, b := range bot.batches {
+		if time.Since(b.opened) > batchExpiry {
+			delete(bot.batches, ref)
+			continue
+		}
+		if oldest == nil || b.opened.Before(oldest.opened) {
+			oldest = b
+		}
+	}
+	if len(bot.batches) >= maxOpenBatches && oldest != nil {
+		delete(bot.batches, oldest.Ref)
+	}
+}
+
+// batchWanted reports whether a batch trigger takes the type
+func (bot *Bot) batchWanted(batchType string) bool {
+	for _, t := range bot.triggers() {
+		if bt, ok := t.handler.(batchTrigger); ok && (bt.batchType == "" || bt.batchType == batchType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bot *Bot) groupBatch(batchType string) bool {
+	for _, t := range bot.GroupBatches {
+		if t == batchType {
+			return true
+		}
+	}
+	return false
+}
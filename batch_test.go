@@ -0,0 +1,118 @@
+package kitty
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchTrigger(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	batches := make(chan *Batch, 2)
+	bot.AddBatchTrigger("netsplit", func(bot *Bot, b *Batch) {
+		batches <- b
+	})
+	all := make(chan *Batch, 2)
+	bot.AddBatchTrigger("", func(bot *Bot, b *Batch) {
+		all <- b
+	})
+	r := &recorder{}
+	bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+		if m.Command == "QUIT" || m.Command == "PRIVMSG" {
+			r.add(m.BatchType + " " + m.Name)
+		}
+	}))
+	c.Send(":irc.test BATCH +outer netsplit irc.a irc.b")
+	c.Send("@batch=outer :alice!a@h QUIT :irc.a irc.b")
+	c.Send("@batch=outer :irc.test BATCH +inner chathistory #test")
+	c.Send("@batch=inner :bob!b@h PRIVMSG #test :hi")
+	c.Send(":irc.test BATCH -inner")
+	c.Send("@batch=outer :carol!c@h QUIT :irc.a irc.b")
+	c.Send(":irc.test BATCH -outer")
+
+	var b *Batch
+	select {
+	case b = <-batches:
+	case <-time.After(time.Second):
+		t.Fatal("no netsplit batch")
+	}
+	if b.Ref != "outer" || len(b.Params) != 2 || b.Params[1] != "irc.b" {
+		t.Fatalf("got batch %+v", b)
+	}
+	if len(b.Messages) != 2 || b.Messages[0].Name != "alice" || b.Messages[1].Name != "carol" {
+		t.Fatalf("got %d messages", len(b.Messages))
+	}
+	// Nested batches arrive inside their parent
+	if len(b.Batches) != 1 || b.Batches[0].Type != "chathistory" || len(b.Batches[0].Messages) != 1 {
+		t.Fatalf("got nested %+v", b.Batches)
+	}
+	if got := <-all; got != b {
+		t.Fatal("the catch-all trigger got another batch")
+	}
+	select {
+	case b := <-all:
+		t.Fatalf("nested batch %s delivered on its own", b.Ref)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Ungrouped messages still reach the triggers one by one
+	r.wait(t, 3)
+	want := map[string]bool{"netsplit alice": true, "chathistory bob": true, "netsplit carol": true}
+	for _, seen := range r.list() {
+		if !want[seen] {
+			t.Fatalf("trigger saw %q", seen)
+		}
+	}
+}
+
+func TestGroupBatches(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.GroupBatches = []string{"chathistory"}
+	})
+	batches := make(chan *Batch, 1)
+	bot.AddBatchTrigger("chathistory", func(bot *Bot, b *Batch) {
+		batches <- b
+	})
+	r := &recorder{}
+	bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+		if m.Command == "PRIVMSG" {
+			r.add(m.Content)
+		}
+	}))
+	c.Send(":irc.test BATCH +h chathistory #test")
+	c.Send("@batch=h :bob!b@h PRIVMSG #test :old")
+	c.Send("@batch=h :bob!b@h PRIVMSG #test :older")
+	c.Send(":irc.test BATCH -h")
+	c.Send(":bob!b@h PRIVMSG #test :new")
+	select {
+	case b := <-batches:
+		if len(b.Messages) != 2 || b.Messages[0].Content != "old" {
+			t.Fatalf("got %d messages", len(b.Messages))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no chathistory batch")
+	}
+	// Grouped messages skip the triggers
+	r.wait(t, 1)
+	time.Sleep(20 * time.Millisecond)
+	if got := r.list(); !equal(got, []string{"new"}) {
+		t.Fatalf("trigger saw %q", got)
+	}
+}
+
+func TestBatchNotCollected(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.batches = make(map[string]*Batch)
+	// Nobody asked for these, their messages aren't kept
+	for _, raw := range []string{
+		":irc.test BATCH +x netsplit irc.a irc.b",
+		"@batch=x :alice!a@h QUIT :irc.a irc.b",
+	} {
+		bot.trackBatch(privmsg(raw))
+	}
+	end := privmsg(":irc.test BATCH -x")
+	bot.trackBatch(end)
+	if end.Completed == nil || end.Completed.Type != "netsplit" || len(end.Completed.Messages) != 0 {
+		t.Fatalf("got %+v", end.Completed)
+	}
+}
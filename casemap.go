@@ -0,0 +1,41 @@
+package kitty
+
+import "strings"
+
+// Casefold folds s to lowercase following the CASEMAPPING
+// advertised by the server, use it for map keys of nicks and channels
+func (bot *Bot) Casefold(s string) string {
+	return casefold(bot.isupport.CaseMapping(), s)
+}
+
+// EqualFold reports whether two nicks or channels are equal
+// under the CASEMAPPING advertised by the server
+func (bot *Bot) EqualFold(a, b string) bool {
+	return bot.Casefold(a) == bot.Casefold(b)
+}
+
+func casefold(mapping, s string) string {
+	switch mapping {
+	case "rfc7613":
+		// Close enough to PRECIS without pulling in x/text
+		return strings.ToLower(s)
+	case "ascii", "rfc1459", "rfc1459-strict":
+	default:
+		mapping = "ascii"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case 'A' <= c && c <= 'Z':
+			b[i] = c + 'a' - 'A'
+		case mapping == "ascii":
+		case c == '[' || c == ']' || c == '\\':
+			// [ ] \ fold to { } |
+			b[i] = c + '{' - '['
+		case c == '^' && mapping == "rfc1459":
+			// ^ folds to ~
+			b[i] = '~'
+		}
+	}
+	return string(b)
+}
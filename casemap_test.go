@@ -0,0 +1,40 @@
+package kitty
+
+import "testing"
+
+func TestCasefold(t *testing.T) {
+	tests := []struct {
+		mapping, in, want string
+	}{
+		{"ascii", "KittyBot", "kittybot"},
+		{"ascii", "[Kitty]\\^~", "[kitty]\\^~"},
+		{"rfc1459", "KittyBot", "kittybot"},
+		{"rfc1459", "[Kitty]\\", "{kitty}|"},
+		{"rfc1459", "^~", "~~"},
+		{"rfc1459", "{}|~", "{}|~"},
+		{"rfc1459-strict", "[Kitty]\\", "{kitty}|"},
+		{"rfc1459-strict", "^~", "^~"},
+		{"rfc7613", "KittyBot[]", "kittybot[]"},
+		{"", "Kitty[]", "kitty[]"},
+		{"unknown", "Kitty^", "kitty^"},
+		{"rfc1459", "ÄÖ", "ÄÖ"},
+	}
+	for _, tt := range tests {
+		if got := casefold(tt.mapping, tt.in); got != tt.want {
+			t.Errorf("casefold(%q, %q) = %q, want %q", tt.mapping, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEqualFold(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	// rfc1459 until the server says otherwise
+	for _, pair := range [][2]string{{"Kitty^Bot", "kitty~bot"}, {"[cat]", "{CAT}"}, {"#Cats", "#cats"}} {
+		if !bot.EqualFold(pair[0], pair[1]) {
+			t.Errorf("%q and %q differ", pair[0], pair[1])
+		}
+	}
+	if bot.EqualFold("kitty", "kitty_") {
+		t.Error("kitty and kitty_ are equal")
+	}
+}
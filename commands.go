@@ -2,6 +2,7 @@ package kitty
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"strings"
 	"unicode/utf8"
@@ -33,6 +34,19 @@ func (bot *Bot) Msg(who, text string) {
 	}
 }
 
+// MsgContext is like Msg but returns an error instead of blocking
+// when ctx is done or the bot is shutting down
+func (bot *Bot) MsgContext(ctx context.Context, who, text string) error {
+	const command = "PRIVMSG"
+	for _, line := range bot.splitText(text, command, who) {
+		err := bot.SendContext(ctx, command+" "+who+" :"+line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // MsgMaxSize returns maximum number of bytes that fit into one message.
 // Useful, for example, if you want to generate a wall of emojis that fit into one message,
 // or you want to cap some output to one message
@@ -50,6 +64,19 @@ func (bot *Bot) Notice(who, text string) {
 	}
 }
 
+// NoticeContext is like Notice but returns an error instead of blocking
+// when ctx is done or the bot is shutting down
+func (bot *Bot) NoticeContext(ctx context.Context, who, text string) error {
+	const command = "NOTICE"
+	for _, line := range bot.splitText(text, command, who) {
+		err := bot.SendContext(ctx, command+" "+who+" :"+line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NoticeMaxSize returns maximum number of bytes that fit into one message.
 // Useful, for example, if you want to generate a wall of emojis that fit into one message,
 // or you want to cap some output to one message
@@ -66,35 +93,144 @@ func (bot *Bot) Part(ch, msg string) {
 
 // Reply sends a message to where the message came from (user or channel)
 func (bot *Bot) Reply(m *Message, text string) {
+	if !bot.replyAllowed(m) {
+		return
+	}
 	const command = "PRIVMSG"
-	who := replyTarget(m)
+	who := bot.replyTarget(m)
 	for _, line := range bot.splitText(text, command, who) {
-		if bot.LimitReplies && bot.limiter.drop() {
-			bot.Logger.Warn("reply-limiter", "dropped",
-				func() string {
-					if len(line) > 30 {
-						return line[:30] + "..."
-					}
-					return line
-				}(),
-			)
+		if bot.replyLimited(line) {
 			continue
 		}
 		bot.Send(command + " " + who + " :" + line)
 	}
 }
 
+// ReplyContext is like Reply but returns an error instead of blocking
+// when ctx is done or the bot is shutting down
+func (bot *Bot) ReplyContext(ctx context.Context, m *Message, text string) error {
+	if !bot.replyAllowed(m) {
+		return nil
+	}
+	const command = "PRIVMSG"
+	who := bot.replyTarget(m)
+	for _, line := range bot.splitText(text, command, who) {
+		if bot.replyLimited(line) {
+			continue
+		}
+		err := bot.SendContext(ctx, command+" "+who+" :"+line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplyThread is like Reply but attaches the reply to m with the +draft/reply tag,
+// so clients can show it as an answer to m.
+// Without message-tags it addresses the sender as "nick: text" in channels
+func (bot *Bot) ReplyThread(m *Message, text string) {
+	for _, line := range bot.threadLines(m, text) {
+		bot.Send(line)
+	}
+}
+
+// ReplyThreadContext is like ReplyThread but returns an error instead of blocking
+// when ctx is done or the bot is shutting down
+func (bot *Bot) ReplyThreadContext(ctx context.Context, m *Message, text string) error {
+	for _, line := range bot.threadLines(m, text) {
+		err := bot.SendContext(ctx, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadLines returns the raw lines of a threaded reply
+func (bot *Bot) threadLines(m *Message, text string) []string {
+	if !bot.replyAllowed(m) {
+		return nil
+	}
+	const command = "PRIVMSG"
+	who := bot.replyTarget(m)
+	var tags map[string]string
+	msgid, ok := m.GetTag("msgid")
+	if enabled, _ := bot.CapStatus(CapMessageTags); enabled && ok && msgid != "" {
+		tags = map[string]string{"+draft/reply": msgid}
+	} else if bot.isupport.IsChannel(who) {
+		text = m.Name + ": " + text
+	}
+	var lines []string
+	for _, line := range bot.splitText(text, command, who) {
+		if bot.replyLimited(line) {
+			continue
+		}
+		out, err := OutMessage{Tags: tags, Command: command, Params: []string{who, line}}.Encode()
+		if err != nil {
+			bot.Error("can't reply", "err", err)
+			continue
+		}
+		lines = append(lines, out)
+	}
+	return lines
+}
+
+// Reports whether ReplyLimiter lets us answer m
+func (bot *Bot) replyAllowed(m *Message) bool {
+	return bot.ReplyLimiter == nil || bot.ReplyLimiter.Allow(bot, m)
+}
+
+// Reports whether the reply limiter dropped the line
+func (bot *Bot) replyLimited(line string) bool {
+	if bot.LimitReplies && bot.limiter.drop() {
+		bot.Logger.Warn("reply-limiter", "dropped",
+			func() string {
+				if len(line) > 30 {
+					return line[:30] + "..."
+				}
+				return line
+			}(),
+		)
+		return true
+	}
+	return false
+}
+
 // ReplyMaxSize is just like MsgMaxSize
 // but calculates message size for the reply target
 func (bot *Bot) ReplyMaxSize(m *Message) int {
 	const command = "PRIVMSG"
-	maxSize := bot.maxMsgSize(command, replyTarget(m))
+	maxSize := bot.maxMsgSize(command, bot.replyTarget(m))
 	return maxSize
 }
 
-// Send any command to the server
+// Send any command to the server.
+// The command is dropped if the bot is not connected
+// or if it contains CR, LF or NUL
 func (bot *Bot) Send(command string) {
-	bot.outgoing <- command
+	if err := validateLine(command); err != nil {
+		bot.Error("dropped invalid command", "command", command)
+		return
+	}
+	if bot.enqueue(context.Background(), bot.doneChan(), queuedLine{line: command}) != nil {
+		bot.Warn("not connected, dropped", "command", command)
+	}
+}
+
+// SendContext sends any command to the server.
+// Instead of blocking it returns ctx.Err() when ctx is done,
+// ErrShuttingDown if the bot is quitting and ErrClosed if the bot is not connected.
+// Commands with CR, LF or NUL fail with ErrInvalidMessage
+func (bot *Bot) SendContext(ctx context.Context, command string) error {
+	if err := validateLine(command); err != nil {
+		return err
+	}
+	done, err := bot.sendable()
+	if err != nil {
+		return err
+	}
+	return bot.enqueue(ctx, done, queuedLine{line: command})
 }
 
 // SetNick sets the bots nick on the irc server.
@@ -110,10 +246,10 @@ func (bot *Bot) Topic(c, topic string) {
 }
 
 func (bot *Bot) maxMsgSize(command, who string) int {
-	// Maximum message size that fits into 512 bytes.
+	// Maximum message size that fits into LINELEN (512 bytes by default).
 	// Carriage return and linefeed are not counted here as they
 	// are added by handleOutgoingMessages()
-	maxSize := 510 - len(fmt.Sprintf(":%s %s %s :", bot.Prefix(), command, who))
+	maxSize := bot.isupport.LineLen() - 2 - len(fmt.Sprintf(":%s %s %s :", bot.Prefix(), command, who))
 	if _, present := bot.CapStatus(CapIdentifyMsg); present {
 		maxSize--
 	}
@@ -124,9 +260,9 @@ func (bot *Bot) maxMsgSize(command, who string) int {
 	return maxSize
 }
 
-func replyTarget(m *Message) string {
+func (bot *Bot) replyTarget(m *Message) string {
 	var target string
-	if strings.Contains(m.To, "#") {
+	if bot.isupport.IsChannel(m.To) {
 		target = m.To
 	} else {
 		target = m.From
@@ -0,0 +1,120 @@
+package kitty
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+func TestSplitText(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	max := bot.maxMsgSize("PRIVMSG", "#test")
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"short", "hello", []string{"hello"}},
+		{"lines", "one\ntwo\r\nthree", []string{"one", "two", "three"}},
+		{"long", strings.Repeat("a", 2*max+5), []string{strings.Repeat("a", max), strings.Repeat("a", max), "aaaaa"}},
+		{"invalid utf-8", "caf\xe9 ok", []string{"caf ok"}},
+	}
+	for _, tt := range tests {
+		got := bot.splitText(tt.text, "PRIVMSG", "#test")
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTextUTF8(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	max := bot.maxMsgSize("PRIVMSG", "#test")
+	// 1, 2, 3 and 4 byte runes so the limit falls inside runes
+	for _, r := range []string{"a", "ä", "€", "🐱"} {
+		for offset := 0; offset < 4; offset++ {
+			text := strings.Repeat("x", offset) + strings.Repeat(r, 3*max/len(r))
+			chunks := bot.splitText(text, "PRIVMSG", "#test")
+			for i, chunk := range chunks {
+				if len(chunk) > max {
+					t.Fatalf("%q offset %d: chunk %d is %d bytes, max %d", r, offset, i, len(chunk), max)
+				}
+				if !utf8.ValidString(chunk) {
+					t.Fatalf("%q offset %d: chunk %d splits a rune", r, offset, i)
+				}
+				if i < len(chunks)-1 && len(chunk)+len(r) <= max {
+					t.Fatalf("%q offset %d: chunk %d is %d bytes, could fit another rune", r, offset, i, len(chunk))
+				}
+			}
+			if strings.Join(chunks, "") != text {
+				t.Fatalf("%q offset %d: chunks don't add up to the text", r, offset)
+			}
+		}
+	}
+}
+
+func TestSplitTextLineLen(t *testing.T) {
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.ISupport = append(srv.ISupport, "LINELEN=1024")
+	})
+	bot, c := startBot(t, srv)
+	waitFor(t, "LINELEN", func() bool { return bot.ISupport().LineLen() == 1024 })
+	// Our prefix is known once the JOIN comes back
+	waitFor(t, "the join", func() bool { return bot.State().IsOn("#test", "kittybot") })
+
+	want := 1024 - 2 - len(fmt.Sprintf(":%s PRIVMSG #test :", bot.Prefix()))
+	if got := bot.maxMsgSize("PRIVMSG", "#test"); got != want {
+		t.Fatalf("max message size is %d with LINELEN=1024, want %d", got, want)
+	}
+	bot.Msg("#test", strings.Repeat("a", 1500))
+	var total int
+	for total < 1500 {
+		m, err := c.Expect(time.Second, `^PRIVMSG #test :`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := len(m.Trailing()) + len("PRIVMSG #test :")
+		if total == 0 && line <= 510 {
+			t.Fatalf("first line is %d bytes, LINELEN=1024 allows more", line)
+		}
+		if line > 1022 {
+			t.Fatalf("line is %d bytes, over LINELEN", line)
+		}
+		total += len(m.Trailing())
+	}
+}
+
+func TestReplyThread(t *testing.T) {
+	for _, tags := range []bool{true, false} {
+		srv := newServer(t, func(srv *kittytest.Server) {
+			if !tags {
+				delete(srv.Caps, CapMessageTags)
+			}
+		})
+		bot, c := startBot(t, srv)
+		bot.ReplyThread(privmsg("@msgid=abc :alice!a@h PRIVMSG #test :hi"), "one")
+		bot.ReplyThread(privmsg(":alice!a@h PRIVMSG #test :hi"), "two")
+		bot.ReplyThread(privmsg("@msgid=def :alice!a@h PRIVMSG kittybot :hi"), "three")
+		bot.ReplyThread(privmsg(":alice!a@h PRIVMSG kittybot :hi"), "four")
+		want := []string{
+			`^@\+draft/reply=abc PRIVMSG #test :?one$`,
+			`^PRIVMSG #test :alice: two$`,
+			`^@\+draft/reply=def PRIVMSG alice :?three$`,
+			`^PRIVMSG alice :?four$`,
+		}
+		// Without message-tags channel replies name the sender instead
+		if !tags {
+			want[0] = `^PRIVMSG #test :alice: one$`
+			want[2] = `^PRIVMSG alice :?three$`
+		}
+		for _, pattern := range want {
+			if _, err := c.Expect(time.Second, pattern); err != nil {
+				t.Fatalf("tags %v: %v", tags, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package kitty
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// CTCPFunc answers a CTCP request, a non-empty return value
+// is sent back to the sender as the CTCP reply
+type CTCPFunc func(bot *Bot, m *Message) string
+
+// IsCTCP reports whether m is a CTCP request (PRIVMSG) or reply (NOTICE),
+// see Message.CTCP and Message.CTCPArgs
+func (m *Message) IsCTCP() bool {
+	return m.CTCP != ""
+}
+
+// IsAction reports whether m is a /me action, the text is in CTCPArgs
+func (m *Message) IsAction() bool {
+	return m.Command == "PRIVMSG" && m.CTCP == "ACTION"
+}
+
+// parseCTCP fills in the CTCP fields of PRIVMSGs and NOTICEs like "\x01PING 123\x01"
+func (m *Message) parseCTCP() {
+	if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
+		return
+	}
+	if len(m.Content) < 2 || m.Content[0] != '\x01' {
+		return
+	}
+	ctcp := strings.TrimSuffix(m.Content[1:], "\x01")
+	split := strings.SplitN(ctcp, " ", 2)
+	m.CTCP = strings.ToUpper(split[0])
+	if len(split) == 2 {
+		m.CTCPArgs = split[1]
+	}
+}
+
+// CTCP sends a CTCP request to 'who' (user or channel)
+func (bot *Bot) CTCP(who, command, args string) {
+	bot.Msg(who, ctcpText(command, args))
+}
+
+// CTCPReply sends a CTCP reply to 'who'
+func (bot *Bot) CTCPReply(who, command, args string) {
+	bot.Notice(who, ctcpText(command, args))
+}
+
+func ctcpText(command, args string) string {
+	if args == "" {
+		return "\x01" + command + "\x01"
+	}
+	return "\x01" + command + " " + args + "\x01"
+}
+
+// HandleCTCP sets the function that answers a CTCP command,
+// replacing the default for VERSION, PING, TIME, SOURCE and CLIENTINFO.
+// A nil function makes the bot ignore the command.
+// Functions run in their own goroutine
+func (bot *Bot) HandleCTCP(command string, f CTCPFunc) {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	if bot.ctcp == nil {
+		bot.ctcp = make(map[string]CTCPFunc)
+	}
+	bot.ctcp[strings.ToUpper(command)] = f
+}
+
+// ctcpFunc returns the function for the command, custom or default
+func (bot *Bot) ctcpFunc(command string) CTCPFunc {
+	bot.mu.Lock()
+	f, ok := bot.ctcp[command]
+	bot.mu.Unlock()
+	if ok {
+		return f
+	}
+	return ctcpDefault(command)
+}
+
+// ctcpDefault returns the built-in function for the command
+func ctcpDefault(command string) CTCPFunc {
+	switch command {
+	case "VERSION":
+		return func(bot *Bot, m *Message) string {
+			return bot.CTCPVersion
+		}
+	case "PING":
+		return func(bot *Bot, m *Message) string {
+			return m.CTCPArgs
+		}
+	case "TIME":
+		return func(bot *Bot, m *Message) string {
+			return time.Now().Format(time.RFC1123Z)
+		}
+	case "SOURCE":
+		return func(bot *Bot, m *Message) string {
+			return bot.CTCPSource
+		}
+	case "CLIENTINFO":
+		return func(bot *Bot, m *Message) string {
+			return strings.Join(bot.ctcpCommands(), " ")
+		}
+	}
+	return nil
+}
+
+// ctcpCommands lists the CTCP commands we answer
+func (bot *Bot) ctcpCommands() []string {
+	commands := []string{"ACTION"}
+	for _, command := range []string{"VERSION", "PING", "TIME", "SOURCE", "CLIENTINFO"} {
+		if bot.ctcpFunc(command) != nil {
+			commands = append(commands, command)
+		}
+	}
+	bot.mu.Lock()
+	for command, f := range bot.ctcp {
+		if f != nil && ctcpDefault(command) == nil {
+			commands = append(commands, command)
+		}
+	}
+	bot.mu.Unlock()
+	sort.Strings(commands)
+	return commands
+}
+
+// Answers CTCP requests
+var ctcpRequest = Trigger{
+	Condition: func(bot *Bot, m *Message) bool {
+		return m.Command == "PRIVMSG" && m.IsCTCP() && !m.IsAction()
+	},
+	Action: func(bot *Bot, m *Message) {
+		f := bot.ctcpFunc(m.CTCP)
+		if f == nil {
+			return
+		}
+		go bot.safeHandle(HandlerFunc(func(bot *Bot, m *Message) {
+			if bot.CTCPLimiter != nil && !bot.CTCPLimiter.Allow(bot, m) {
+				return
+			}
+			if reply := f(bot, m); reply != "" {
+				bot.CTCPReply(m.Name, m.CTCP, reply)
+			}
+		}), m)
+	},
+}
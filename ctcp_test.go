@@ -0,0 +1,75 @@
+package kitty
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCTCPDefaults(t *testing.T) {
+	srv := newServer(t)
+	_, c := startBot(t, srv, func(bot *Bot) {
+		bot.CTCPLimiter = nil
+	})
+	tests := []struct{ request, reply string }{
+		{"VERSION", `VERSION kittybot`},
+		{"PING 123 456", `PING 123 456`},
+		{"TIME", `TIME \w{3}, \d{2} \w{3} \d{4} \d{2}:\d{2}:\d{2} [+-]\d{4}`},
+		{"SOURCE", `SOURCE https://github\.com/ugjka/kittybot`},
+		{"CLIENTINFO", `CLIENTINFO ACTION CLIENTINFO PING SOURCE TIME VERSION`},
+	}
+	for _, tt := range tests {
+		c.Send(":alice!a@h PRIVMSG kittybot :\x01" + tt.request + "\x01")
+		if _, err := c.Expect(time.Second, "^NOTICE alice :\x01"+tt.reply+"\x01$"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleCTCP(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.CTCPLimiter = nil
+	})
+	bot.HandleCTCP("version", nil)
+	bot.HandleCTCP("TIME", nil)
+	bot.HandleCTCP("finger", func(bot *Bot, m *Message) string {
+		return "a cat, " + m.Name
+	})
+	// Ignored commands don't answer, the PING after them shows we're done waiting
+	for _, request := range []string{"VERSION", "TIME", "FINGER", "CLIENTINFO", "PING x"} {
+		c.Send(":alice!a@h PRIVMSG kittybot :\x01" + request + "\x01")
+	}
+	if _, err := c.Expect(time.Second, "^NOTICE alice :\x01PING x\x01$"); err != nil {
+		t.Fatal(err)
+	}
+	// Replies come from goroutines, give the others a moment
+	waitFor(t, "all replies", func() bool {
+		var n int
+		for _, line := range c.Lines() {
+			if strings.HasPrefix(line, "NOTICE alice") {
+				n++
+			}
+		}
+		return n >= 3
+	})
+	var replies []string
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, "NOTICE alice") {
+			replies = append(replies, line)
+		}
+	}
+	want := map[string]bool{
+		"NOTICE alice :\x01FINGER a cat, alice\x01":                             true,
+		"NOTICE alice :\x01CLIENTINFO ACTION CLIENTINFO FINGER PING SOURCE\x01": true,
+		"NOTICE alice :\x01PING x\x01":                                          true,
+	}
+	if len(replies) != len(want) {
+		t.Fatalf("got %q", replies)
+	}
+	for _, reply := range replies {
+		if !want[reply] {
+			t.Fatalf("unexpected %q", reply)
+		}
+	}
+}
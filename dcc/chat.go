@@ -0,0 +1,50 @@
+package dcc
+
+import (
+	"bufio"
+	"net"
+	"strings"
+)
+
+// Chat is a DCC CHAT session, a line based connection to another user
+type Chat struct {
+	// Nick of the peer
+	Nick string
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newChat(nick string, conn net.Conn) *Chat {
+	return &Chat{Nick: nick, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Read implements io.Reader
+func (c *Chat) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write implements io.Writer
+func (c *Chat) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+// Close closes the session
+func (c *Chat) Close() error {
+	return c.conn.Close()
+}
+
+// ReadLine returns the next line without the line ending
+func (c *Chat) ReadLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// WriteLine sends a line, newlines in it start new lines
+func (c *Chat) WriteLine(line string) error {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	return err
+}
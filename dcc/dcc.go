@@ -0,0 +1,555 @@
+// Package dcc adds DCC CHAT and DCC SEND to a kitty.Bot.
+//
+// It supports active and passive (reverse) connections, so users behind NAT
+// can still receive files. Create a Manager with NewManager, set PublicIP to the
+// address peers should connect to and Accept and OnOffer to take incoming offers.
+//
+// The ports we listen on are unauthenticated, set CheckPeer
+// to keep others from taking a file or chat meant for the peer.
+package dcc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kitty "github.com/ugjka/kittybot"
+)
+
+var (
+	// ErrNoPublicIP is returned when an offer needs PublicIP and it isn't set
+	ErrNoPublicIP = errors.New("dcc: PublicIP is not set")
+	// ErrNoPort is returned when no port in the port range is free
+	ErrNoPort = errors.New("dcc: no free port in range")
+	// ErrTooLarge is returned when a file is larger than MaxSize
+	ErrTooLarge = errors.New("dcc: file too large")
+	// ErrWrongType is returned when accepting an offer the wrong way,
+	// like calling Receive on a CHAT offer
+	ErrWrongType = errors.New("dcc: wrong offer type")
+)
+
+// Progress is called as data is transferred, total is 0 if the size is unknown
+type Progress func(transferred, total int64)
+
+// Manager handles DCC for a bot
+type Manager struct {
+	// Address peers connect to, usually the bot's public IPv4 address
+	PublicIP net.IP
+	// Ports to listen on, 0 picks any free port
+	PortMin, PortMax int
+	// Largest file to receive, 0 means no limit
+	MaxSize int64
+	// How long to wait for a peer to connect or to send data (default 2m)
+	Timeout time.Duration
+	// Make outgoing offers passive, so the peer listens and we connect.
+	// Use it when the bot can't accept connections
+	Passive bool
+	// Decides which incoming offers get to OnOffer, nil accepts none
+	Accept func(o *Offer) bool
+	// Runs in its own goroutine for every accepted offer,
+	// call o.Receive or o.Chat to take it
+	OnOffer func(o *Offer)
+	// Decides whether a connection to one of our ports comes from nick.
+	// With nil whoever connects first gets the file or chat,
+	// MatchHost is a ready made check
+	CheckPeer func(nick string, addr net.Addr) bool
+
+	bot     *kitty.Bot
+	mu      sync.Mutex
+	pending map[string]chan *Offer
+}
+
+// NewManager creates a Manager and makes the bot answer DCC requests
+func NewManager(bot *kitty.Bot) *Manager {
+	m := &Manager{
+		Timeout: 2 * time.Minute,
+		bot:     bot,
+		pending: make(map[string]chan *Offer),
+	}
+	bot.HandleCTCP("DCC", m.handle)
+	return m
+}
+
+// Offer is a DCC request from another user
+type Offer struct {
+	// "SEND" or "CHAT"
+	Type string
+	// Nick of the sender
+	From string
+	// File name without any directories, SEND only
+	Filename string
+	// File size, 0 if unknown
+	Size int64
+	IP   net.IP
+	Port int
+	// Set for passive offers, where the peer can't accept
+	// connections and waits for us to listen
+	Token string
+
+	m *Manager
+}
+
+// Passive reports whether we have to listen for the peer
+func (o *Offer) Passive() bool {
+	return o.Port == 0 && o.Token != ""
+}
+
+// Receive accepts a SEND offer and writes the file to w
+func (o *Offer) Receive(ctx context.Context, w io.Writer, progress Progress) error {
+	if o.Type != "SEND" {
+		return ErrWrongType
+	}
+	if o.m.MaxSize > 0 && o.Size > o.m.MaxSize {
+		return ErrTooLarge
+	}
+	conn, err := o.connect(ctx, func(ip string, port int) string {
+		return fmt.Sprintf("SEND %s %s %d %d %s", quoteName(o.Filename), ip, port, o.Size, o.Token)
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return o.m.receive(conn, w, o.Size, progress)
+}
+
+// Chat accepts a CHAT offer
+func (o *Offer) Chat(ctx context.Context) (*Chat, error) {
+	if o.Type != "CHAT" {
+		return nil, ErrWrongType
+	}
+	conn, err := o.connect(ctx, func(ip string, port int) string {
+		return fmt.Sprintf("CHAT chat %s %d %s", ip, port, o.Token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newChat(o.From, conn), nil
+}
+
+// connect dials the peer or, for passive offers, listens and
+// tells the peer where to connect with the reply built by reply
+func (o *Offer) connect(ctx context.Context, reply func(ip string, port int) string) (net.Conn, error) {
+	m := o.m
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+	if !o.Passive() {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(o.IP.String(), strconv.Itoa(o.Port)))
+	}
+	if m.PublicIP == nil {
+		return nil, ErrNoPublicIP
+	}
+	l, err := m.listen()
+	if err != nil {
+		return nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	m.bot.CTCP(o.From, "DCC", reply(encodeIP(m.PublicIP), port))
+	return m.accept(ctx, l, o.From)
+}
+
+// SendFile offers the file at path to nick and sends it once the peer connects
+func (m *Manager) SendFile(ctx context.Context, nick, path string, progress Progress) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return m.Send(ctx, nick, filepath.Base(path), f, info.Size(), progress)
+}
+
+// Send offers size bytes from r to nick as a file called name
+// and sends them once the peer connects
+func (m *Manager) Send(ctx context.Context, nick, name string, r io.Reader, size int64, progress Progress) error {
+	conn, err := m.offer(ctx, nick, func(ip string, port int, token string) string {
+		return strings.TrimSpace(fmt.Sprintf("SEND %s %s %d %d %s", quoteName(name), ip, port, size, token))
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return m.send(conn, r, size, progress)
+}
+
+// Chat offers a DCC CHAT to nick
+func (m *Manager) Chat(ctx context.Context, nick string) (*Chat, error) {
+	conn, err := m.offer(ctx, nick, func(ip string, port int, token string) string {
+		return strings.TrimSpace(fmt.Sprintf("CHAT chat %s %d %s", ip, port, token))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newChat(nick, conn), nil
+}
+
+// offer sends the offer built by args and waits for the peer
+// to connect, or with Passive for the peer's reply
+func (m *Manager) offer(ctx context.Context, nick string, args func(ip string, port int, token string) string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+	if !m.Passive {
+		if m.PublicIP == nil {
+			return nil, ErrNoPublicIP
+		}
+		l, err := m.listen()
+		if err != nil {
+			return nil, err
+		}
+		m.bot.CTCP(nick, "DCC", args(encodeIP(m.PublicIP), l.Addr().(*net.TCPAddr).Port, ""))
+		return m.accept(ctx, l, nick)
+	}
+
+	token := newToken()
+	replies := make(chan *Offer, 1)
+	m.mu.Lock()
+	m.pending[token] = replies
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, token)
+		m.mu.Unlock()
+	}()
+	m.bot.CTCP(nick, "DCC", args("0", 0, token))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case reply := <-replies:
+			if !m.bot.EqualFold(reply.From, nick) {
+				continue
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", net.JoinHostPort(reply.IP.String(), strconv.Itoa(reply.Port)))
+		}
+	}
+}
+
+// handle is the CTCP DCC handler
+func (m *Manager) handle(bot *kitty.Bot, msg *kitty.Message) string {
+	if bot.ISupport().IsChannel(msg.To) {
+		return ""
+	}
+	o, err := parseOffer(msg.CTCPArgs)
+	if err != nil {
+		bot.Debug("bad dcc offer", "from", msg.Name, "err", err)
+		return ""
+	}
+	o.From = msg.Name
+	o.m = m
+	// The peer answers one of our passive offers
+	if o.Token != "" && o.Port != 0 {
+		m.mu.Lock()
+		replies, ok := m.pending[o.Token]
+		m.mu.Unlock()
+		if ok {
+			select {
+			case replies <- o:
+			default:
+			}
+			return ""
+		}
+	}
+	if o.Type == "SEND" && m.MaxSize > 0 && o.Size > m.MaxSize {
+		bot.Info("dcc offer too large", "from", o.From, "file", o.Filename, "size", o.Size)
+		return ""
+	}
+	if m.Accept == nil || m.OnOffer == nil || !m.Accept(o) {
+		return ""
+	}
+	m.OnOffer(o)
+	return ""
+}
+
+// send writes the data and waits for the peer to acknowledge all of it
+func (m *Manager) send(conn net.Conn, r io.Reader, size int64, progress Progress) error {
+	acked := make(chan error, 1)
+	go func() {
+		ack := make([]byte, 4)
+		for {
+			_, err := io.ReadFull(conn, ack)
+			if err != nil {
+				acked <- err
+				return
+			}
+			// Acks are 32 bit, they wrap for files over 4GiB
+			if binary.BigEndian.Uint32(ack) == uint32(size) {
+				acked <- nil
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 32*1024)
+	var sent int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(m.timeout()))
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return err
+			}
+			sent += int64(n)
+			if progress != nil {
+				progress(sent, size)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if sent == 0 {
+		return nil
+	}
+	timer := time.NewTimer(m.timeout())
+	defer timer.Stop()
+	select {
+	case err := <-acked:
+		// Some clients close instead of sending the last ack
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// receive reads the file and acknowledges every chunk
+func (m *Manager) receive(conn net.Conn, w io.Writer, size int64, progress Progress) error {
+	buf := make([]byte, 32*1024)
+	ack := make([]byte, 4)
+	var received int64
+	for size <= 0 || received < size {
+		conn.SetReadDeadline(time.Now().Add(m.timeout()))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			received += int64(n)
+			if m.MaxSize > 0 && received > m.MaxSize {
+				return ErrTooLarge
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint32(ack, uint32(received))
+			if _, err := conn.Write(ack); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(received, size)
+			}
+		}
+		if err == io.EOF {
+			if size > 0 && received < size {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen opens a listener in the port range
+func (m *Manager) listen() (net.Listener, error) {
+	if m.PortMin == 0 {
+		return net.Listen("tcp", ":0")
+	}
+	max := m.PortMax
+	if max < m.PortMin {
+		max = m.PortMin
+	}
+	for port := m.PortMin; port <= max; port++ {
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, ErrNoPort
+}
+
+func (m *Manager) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return 2 * time.Minute
+	}
+	return m.Timeout
+}
+
+// accept waits for a connection from nick, see CheckPeer,
+// and closes the listener
+func (m *Manager) accept(ctx context.Context, l net.Listener, nick string) (net.Conn, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if m.CheckPeer == nil || m.CheckPeer(nick, conn.RemoteAddr()) {
+			return conn, nil
+		}
+		m.bot.Info("dcc connection not from the peer", "nick", nick, "addr", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// MatchHost reports whether addr belongs to the host nick is connected from,
+// as known to the bot's state tracker. Cloaked and unknown hosts never match
+func (m *Manager) MatchHost(nick string, addr net.Addr) bool {
+	user, ok := m.bot.State().User(nick)
+	if !ok {
+		return false
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if ip := net.ParseIP(user.Host); ip != nil {
+		return ip.Equal(tcp.IP)
+	}
+	ips, err := net.LookupIP(user.Host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOffer parses "SEND file ip port size [token]" or "CHAT chat ip port [token]"
+func parseOffer(args string) (*Offer, error) {
+	fields := splitArgs(args)
+	if len(fields) < 4 {
+		return nil, errors.New("not enough arguments")
+	}
+	o := &Offer{Type: strings.ToUpper(fields[0])}
+	var rest []string
+	switch o.Type {
+	case "SEND":
+		if len(fields) < 5 {
+			return nil, errors.New("missing size")
+		}
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.New("bad size")
+		}
+		o.Size = size
+		o.Filename = cleanName(fields[1])
+		rest = fields[5:]
+	case "CHAT":
+		rest = fields[4:]
+	default:
+		return nil, fmt.Errorf("unsupported type %s", o.Type)
+	}
+	o.IP = decodeIP(fields[2])
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("bad port")
+	}
+	o.Port = port
+	if len(rest) > 0 {
+		o.Token = rest[0]
+	}
+	if o.IP == nil && !o.Passive() {
+		return nil, errors.New("bad address")
+	}
+	return o, nil
+}
+
+// splitArgs splits on spaces, keeping "quoted file names" together
+func splitArgs(args string) []string {
+	var fields []string
+	for {
+		args = strings.TrimLeft(args, " ")
+		if args == "" {
+			return fields
+		}
+		if args[0] == '"' {
+			if end := strings.IndexByte(args[1:], '"'); end >= 0 {
+				fields = append(fields, args[1:end+1])
+				args = args[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexByte(args, ' ')
+		if end < 0 {
+			return append(fields, args)
+		}
+		fields = append(fields, args[:end])
+		args = args[end:]
+	}
+}
+
+func quoteName(name string) string {
+	name = strings.ReplaceAll(name, `"`, "'")
+	if strings.IndexByte(name, ' ') >= 0 {
+		return `"` + name + `"`
+	}
+	return name
+}
+
+// cleanName keeps peers from writing outside the download directory
+func cleanName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// IPv4 addresses are sent as a decimal number, IPv6 as is
+func encodeIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	return ip.String()
+}
+
+func decodeIP(s string) net.IP {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		if n == 0 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+		return ip
+	}
+	return net.ParseIP(s)
+}
+
+func newToken() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
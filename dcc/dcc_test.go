@@ -0,0 +1,333 @@
+package dcc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	kitty "github.com/ugjka/kittybot"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+var localhost = net.IPv4(127, 0, 0, 1)
+
+// startBot runs a bot on the server and waits for it to join
+func startBot(t *testing.T, srv *kittytest.Server, nick string) (*kitty.Bot, *kittytest.Client) {
+	t.Helper()
+	bot := kitty.NewBot(srv.Addr(), nick, func(bot *kitty.Bot) {
+		bot.ThrottleDelay = 0
+		bot.CTCPLimiter = nil
+	})
+	done := make(chan struct{})
+	go func() {
+		bot.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		bot.Close()
+		<-done
+	})
+	c, err := srv.NextClient(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-bot.Joined:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s didn't join", nick)
+	}
+	return bot, c
+}
+
+// managers returns the managers of alice, who offers, and bob, who takes offers
+func managers(t *testing.T) (alice, bob *Manager) {
+	alice, bob, _, _ = managersClients(t)
+	return alice, bob
+}
+
+// managersClients also returns the server side of alice's and bob's connections
+func managersClients(t *testing.T) (alice, bob *Manager, aliceClient, bobClient *kittytest.Client) {
+	t.Helper()
+	srv := kittytest.NewServer()
+	t.Cleanup(srv.Close)
+	aliceBot, aliceClient := startBot(t, srv, "alice")
+	bobBot, bobClient := startBot(t, srv, "bob")
+	alice, bob = NewManager(aliceBot), NewManager(bobBot)
+	for _, m := range []*Manager{alice, bob} {
+		m.PublicIP = localhost
+		m.Timeout = 2 * time.Second
+	}
+	bob.Accept = func(o *Offer) bool { return o.From == "alice" }
+	return alice, bob, aliceClient, bobClient
+}
+
+func TestSend(t *testing.T) {
+	data := make([]byte, 300000)
+	rand.Read(data)
+	for _, passive := range []bool{false, true} {
+		alice, bob := managers(t)
+		alice.Passive = passive
+		type result struct {
+			offer *Offer
+			data  []byte
+			err   error
+		}
+		results := make(chan result, 1)
+		bob.OnOffer = func(o *Offer) {
+			var buf bytes.Buffer
+			err := o.Receive(context.Background(), &buf, nil)
+			results <- result{o, buf.Bytes(), err}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var sent int64
+		err := alice.Send(ctx, "bob", "my 100%done.bin", bytes.NewReader(data), int64(len(data)), func(n, total int64) { sent = n })
+		cancel()
+		if err != nil {
+			t.Fatalf("passive %v: %v", passive, err)
+		}
+		if sent != int64(len(data)) {
+			t.Fatalf("passive %v: progress stopped at %d", passive, sent)
+		}
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("passive %v: %v", passive, r.err)
+		}
+		if r.offer.Passive() != passive || r.offer.Filename != "my 100%done.bin" || r.offer.Size != int64(len(data)) {
+			t.Fatalf("passive %v: got offer %+v", passive, r.offer)
+		}
+		if !bytes.Equal(r.data, data) {
+			t.Fatalf("passive %v: received data differs", passive)
+		}
+	}
+}
+
+func TestOfferText(t *testing.T) {
+	alice, bob, aliceClient, bobClient := managersClients(t)
+	alice.Passive = true
+	bob.OnOffer = func(o *Offer) {
+		o.Receive(context.Background(), io.Discard, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := alice.Send(ctx, "bob", "100%d one.txt", strings.NewReader("abc"), 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := aliceClient.Expect(time.Second, "^PRIVMSG bob :\x01DCC SEND \"100%d one\\.txt\" 0 0 3 [0-9a-f]+\x01$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(strings.Trim(m.Trailing(), "\x01"))
+	token := fields[len(fields)-1]
+	if _, err := bobClient.Expect(time.Second, "^PRIVMSG alice :\x01DCC SEND \"100%d one\\.txt\" 2130706433 [0-9]+ 3 "+token+"\x01$"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChat(t *testing.T) {
+	for _, passive := range []bool{false, true} {
+		alice, bob := managers(t)
+		alice.Passive = passive
+		bob.OnOffer = func(o *Offer) {
+			c, err := o.Chat(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			line, _ := c.ReadLine()
+			c.WriteLine("echo " + line)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, err := alice.Chat(ctx, "bob")
+		cancel()
+		if err != nil {
+			t.Fatalf("passive %v: %v", passive, err)
+		}
+		c.WriteLine("meow")
+		line, err := c.ReadLine()
+		c.Close()
+		if err != nil || line != "echo meow" {
+			t.Fatalf("passive %v: got %q, %v", passive, line, err)
+		}
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	alice, bob := managers(t)
+	var checked []string
+	alice.CheckPeer = func(nick string, addr net.Addr) bool {
+		checked = append(checked, nick)
+		return len(checked) > 1
+	}
+	received := make(chan string, 1)
+	bob.OnOffer = func(o *Offer) {
+		// A stranger gets to alice's port first and is turned away
+		stranger, err := net.Dial("tcp", net.JoinHostPort(o.IP.String(), strconv.Itoa(o.Port)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := stranger.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("stranger got %v, want io.EOF", err)
+		}
+		stranger.Close()
+		var buf bytes.Buffer
+		o.Receive(context.Background(), &buf, nil)
+		received <- buf.String()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := alice.Send(ctx, "bob", "x", strings.NewReader("meow"), 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "meow" {
+		t.Fatalf("bob received %q", got)
+	}
+	if len(checked) != 2 || checked[0] != "bob" || checked[1] != "bob" {
+		t.Fatalf("checked %q, want bob twice", checked)
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	alice, _ := managers(t)
+	addr := &net.TCPAddr{IP: localhost, Port: 5000}
+	// Unknown nicks and kittytest's host never match
+	for _, nick := range []string{"nobody", "bob"} {
+		if alice.MatchHost(nick, addr) {
+			t.Errorf("%s matched %v", nick, addr)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	alice, bob := managers(t)
+	bob.MaxSize = 1 << 20
+	offered := make(chan *Offer, 1)
+	bob.OnOffer = func(o *Offer) { offered <- o }
+	// Too large offers never reach OnOffer, so nobody connects
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := alice.Send(ctx, "bob", "big", bytes.NewReader(nil), 2<<20, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	select {
+	case o := <-offered:
+		t.Fatalf("offer of %d bytes accepted", o.Size)
+	default:
+	}
+
+	o := &Offer{Type: "SEND", Size: 2 << 20, IP: localhost, Port: 1, m: bob}
+	if err := o.Receive(context.Background(), io.Discard, nil); err != ErrTooLarge {
+		t.Fatalf("Receive: got %v, want ErrTooLarge", err)
+	}
+	if _, err := o.Chat(context.Background()); err != ErrWrongType {
+		t.Fatalf("Chat on a SEND offer: got %v, want ErrWrongType", err)
+	}
+
+	// A peer that sends more than it offered
+	m := &Manager{MaxSize: 10}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		peer.Write(make([]byte, 20))
+		io.Copy(io.Discard, peer)
+	}()
+	if err := m.receive(conn, io.Discard, 0, nil); err != ErrTooLarge {
+		t.Fatalf("receive: got %v, want ErrTooLarge", err)
+	}
+	conn.Close()
+}
+
+func TestCleanName(t *testing.T) {
+	tests := map[string]string{
+		"file.txt":          "file.txt",
+		"../../etc/passwd":  "passwd",
+		"/etc/passwd":       "passwd",
+		`..\..\windows\x`:   "x",
+		`C:\Users\cat.png`:  "cat.png",
+		"dir/":              "dir",
+		"..":                "file",
+		".":                 "file",
+		"/":                 "file",
+		`\`:                 "file",
+		"":                  "file",
+		"my file.bin":       "my file.bin",
+		"../my file.bin/..": "file",
+	}
+	for name, want := range tests {
+		if got := cleanName(name); got != want {
+			t.Errorf("cleanName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseOffer(t *testing.T) {
+	tests := []struct {
+		args string
+		want *Offer
+	}{
+		{`SEND file.txt 2130706433 5000 1234`, &Offer{Type: "SEND", Filename: "file.txt", IP: localhost, Port: 5000, Size: 1234}},
+		{`send "my file.txt" 2130706433 5000 1234`, &Offer{Type: "SEND", Filename: "my file.txt", IP: localhost, Port: 5000, Size: 1234}},
+		{`SEND "../../a b" 0 0 10 abc123`, &Offer{Type: "SEND", Filename: "a b", Port: 0, Size: 10, Token: "abc123"}},
+		{`SEND x ::1 5000 10 abc123`, &Offer{Type: "SEND", Filename: "x", IP: net.ParseIP("::1"), Port: 5000, Size: 10, Token: "abc123"}},
+		{`CHAT chat 2130706433 5000`, &Offer{Type: "CHAT", IP: localhost, Port: 5000}},
+		{`CHAT chat 0 0 tok`, &Offer{Type: "CHAT", Token: "tok"}},
+		{`SEND x 2130706433 5000`, nil},
+		{`SEND x 2130706433 5000 -1`, nil},
+		{`SEND x 2130706433 70000 10`, nil},
+		{`SEND x 0 5000 10`, nil},
+		{`SEND x 0 0 10`, nil},
+		{`RESUME x 5000 0`, nil},
+		{`CHAT chat`, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseOffer(tt.args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: parsed as %+v", tt.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if got.Type != tt.want.Type || got.Filename != tt.want.Filename || !got.IP.Equal(tt.want.IP) ||
+			got.Port != tt.want.Port || got.Size != tt.want.Size || got.Token != tt.want.Token {
+			t.Errorf("%q: got %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestIP(t *testing.T) {
+	tests := []struct {
+		ip  net.IP
+		enc string
+	}{
+		{localhost, "2130706433"},
+		{net.IPv4(192, 168, 1, 2), "3232235778"},
+		{net.IPv4(255, 255, 255, 255), "4294967295"},
+		{net.ParseIP("2001:db8::1"), "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		if got := encodeIP(tt.ip); got != tt.enc {
+			t.Errorf("encodeIP(%v) = %q, want %q", tt.ip, got, tt.enc)
+		}
+		if got := decodeIP(tt.enc); !got.Equal(tt.ip) {
+			t.Errorf("decodeIP(%q) = %v, want %v", tt.enc, got, tt.ip)
+		}
+	}
+	for _, bad := range []string{"0", "4294967296", "host", ""} {
+		if ip := decodeIP(bad); ip != nil {
+			t.Errorf("decodeIP(%q) = %v, want nil", bad, ip)
+		}
+	}
+}
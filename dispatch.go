@@ -0,0 +1,155 @@
+package kitty
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchMode controls how incoming messages are handed to triggers
+type DispatchMode int
+
+const (
+	// DispatchConcurrent runs every handler for every message
+	// in its own goroutine, there is no ordering (default)
+	DispatchConcurrent DispatchMode = iota
+	// DispatchSerial runs handlers one message at a time,
+	// in the order the messages arrived and the handlers were added
+	DispatchSerial
+	// DispatchPerTarget is like DispatchSerial but keeps one queue
+	// per channel or nick, so a slow channel doesn't hold up the others
+	DispatchPerTarget
+)
+
+// Middleware wraps the handler chain,
+// it can inspect or drop messages before passing them on to next
+type Middleware func(next Handler) Handler
+
+// HandlerFunc is a function that implements Handler
+type HandlerFunc func(*Bot, *Message)
+
+// Handle calls f(bot, m)
+func (f HandlerFunc) Handle(bot *Bot, m *Message) {
+	f(bot, m)
+}
+
+// Use adds middleware to the bot, the first one added runs first.
+// Middleware only wraps user triggers, the bot's internal handlers always see every message
+func (bot *Bot) Use(middleware ...Middleware) {
+	bot.mu.Lock()
+	bot.middleware = append(bot.middleware, middleware...)
+	bot.mu.Unlock()
+}
+
+// StopPropagation stops the message from reaching later handlers.
+// It only has an effect with DispatchSerial and DispatchPerTarget
+func (m *Message) StopPropagation() {
+	atomic.StoreInt32(&m.stopped, 1)
+}
+
+// Stopped reports whether StopPropagation was called
+func (m *Message) Stopped() bool {
+	return atomic.LoadInt32(&m.stopped) == 1
+}
+
+// dispatch runs the internal handlers in order and
+// then hands the message to the triggers
+func (bot *Bot) dispatch(m *Message) {
+	for _, h := range bot.internal {
+		bot.safeHandle(h, m)
+	}
+	if m.grouped {
+		return
+	}
+
+	bot.mu.Lock()
+	middleware := bot.middleware
+	bot.mu.Unlock()
+	var chain Handler = HandlerFunc(bot.runHandlers)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		chain = middleware[i](chain)
+	}
+
+	switch bot.Dispatch {
+	case DispatchSerial:
+		bot.queues.push("", func() { bot.safeHandle(chain, m) })
+	case DispatchPerTarget:
+		key := bot.Casefold(bot.replyTarget(m))
+		bot.queues.push(key, func() { bot.safeHandle(chain, m) })
+	default:
+		go bot.safeHandle(chain, m)
+	}
+}
+
+// runHandlers is the end of the middleware chain
+func (bot *Bot) runHandlers(_ *Bot, m *Message) {
+	handlers := bot.triggers()
+	if bot.Dispatch == DispatchConcurrent {
+		for _, t := range handlers {
+			if t.enabled() {
+				go bot.safeHandle(t.handler, m)
+			}
+		}
+		return
+	}
+	for _, t := range handlers {
+		if m.Stopped() {
+			return
+		}
+		if t.enabled() {
+			bot.safeHandle(t.handler, m)
+		}
+	}
+}
+
+// safeHandle runs the handler and recovers from its panics
+func (bot *Bot) safeHandle(h Handler, m *Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			bot.Error("handler panic", "panic", r, "raw", m.Raw, "stack", string(stack))
+			if bot.OnHandlerPanic != nil {
+				bot.OnHandlerPanic(bot, m, r, stack)
+			}
+		}
+	}()
+	h.Handle(bot, m)
+}
+
+// workQueues runs jobs in order per key,
+// with one goroutine per key that exits when its queue is empty
+type workQueues struct {
+	mu     sync.Mutex
+	queues map[string]*[]func()
+}
+
+func (wq *workQueues) push(key string, job func()) {
+	wq.mu.Lock()
+	if wq.queues == nil {
+		wq.queues = make(map[string]*[]func())
+	}
+	if q, ok := wq.queues[key]; ok {
+		*q = append(*q, job)
+		wq.mu.Unlock()
+		return
+	}
+	q := &[]func(){job}
+	wq.queues[key] = q
+	wq.mu.Unlock()
+
+	go func() {
+		for {
+			wq.mu.Lock()
+			if len(*q) == 0 {
+				delete(wq.queues, key)
+				wq.mu.Unlock()
+				return
+			}
+			job := (*q)[0]
+			(*q)[0] = nil
+			*q = (*q)[1:]
+			wq.mu.Unlock()
+			job()
+		}
+	}()
+}
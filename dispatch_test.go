@@ -0,0 +1,191 @@
+package kitty
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// recorder collects what handlers saw, in the order they saw it
+type recorder struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (r *recorder) add(s string) {
+	r.mu.Lock()
+	r.seen = append(r.seen, s)
+	r.mu.Unlock()
+}
+
+func (r *recorder) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.seen...)
+}
+
+// wait waits for n records
+func (r *recorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+	waitFor(t, strconv.Itoa(n)+" records", func() bool { return len(r.list()) >= n })
+	return r.list()
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDispatchSerial(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.Dispatch = DispatchSerial
+	r := &recorder{}
+	for _, name := range []string{"a", "b"} {
+		name := name
+		bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+			r.add(name + m.Content)
+		}))
+	}
+	var want []string
+	for i := 0; i < 20; i++ {
+		n := strconv.Itoa(i)
+		bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :" + n))
+		want = append(want, "a"+n, "b"+n)
+	}
+	if got := r.wait(t, len(want)); !equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDispatchPerTarget(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.Dispatch = DispatchPerTarget
+	release := make(chan struct{})
+	r := &recorder{}
+	bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+		if m.Content == "slow" {
+			<-release
+		}
+		r.add(m.To + " " + m.Content)
+	}))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #slow :slow"))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #slow :1"))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #fast :1"))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #fast :2"))
+	// #fast isn't held up by #slow
+	if got := r.wait(t, 2); !equal(got, []string{"#fast 1", "#fast 2"}) {
+		t.Fatalf("got %v", got)
+	}
+	close(release)
+	if got := r.wait(t, 4); !equal(got[2:], []string{"#slow slow", "#slow 1"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestStopPropagation(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchSerial, DispatchPerTarget} {
+		bot := NewBot("irc.test:6667", "kittybot")
+		bot.Dispatch = mode
+		r := &recorder{}
+		bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+			r.add("first " + m.Content)
+			if m.Content == "stop" {
+				m.StopPropagation()
+			}
+		}))
+		bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+			r.add("second " + m.Content)
+		}))
+		bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :stop"))
+		bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :go"))
+		want := []string{"first stop", "first go", "second go"}
+		if got := r.wait(t, len(want)); !equal(got, want) {
+			t.Fatalf("mode %d: got %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.Dispatch = DispatchSerial
+	r := &recorder{}
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(bot *Bot, m *Message) {
+				r.add(name)
+				next.Handle(bot, m)
+			})
+		}
+	}
+	bot.Use(mark("outer"), mark("inner"))
+	// Middleware can drop messages
+	bot.Use(func(next Handler) Handler {
+		return HandlerFunc(func(bot *Bot, m *Message) {
+			if m.Content != "drop" {
+				next.Handle(bot, m)
+			}
+		})
+	})
+	bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+		r.add("trigger " + m.Content)
+	}))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :drop"))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :keep"))
+	want := []string{"outer", "inner", "outer", "inner", "trigger keep"}
+	if got := r.wait(t, len(want)); !equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchConcurrent, DispatchSerial, DispatchPerTarget} {
+		bot := NewBot("irc.test:6667", "kittybot")
+		bot.Dispatch = mode
+		panics := make(chan interface{}, 2)
+		bot.OnHandlerPanic = func(bot *Bot, m *Message, recovered interface{}, stack []byte) {
+			if len(stack) == 0 {
+				t.Error("no stack")
+			}
+			panics <- recovered
+		}
+		r := &recorder{}
+		bot.Use(func(next Handler) Handler {
+			return HandlerFunc(func(bot *Bot, m *Message) {
+				if m.Content == "middleware" {
+					panic("middleware")
+				}
+				next.Handle(bot, m)
+			})
+		})
+		bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+			if m.Content == "trigger" {
+				panic("trigger")
+			}
+		}))
+		bot.AddTrigger(HandlerFunc(func(bot *Bot, m *Message) {
+			r.add(m.Content)
+		}))
+		for _, text := range []string{"middleware", "trigger", "after"} {
+			bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :" + text))
+		}
+		// The other trigger still gets the message that made one panic
+		got := r.wait(t, 2)
+		if mode != DispatchConcurrent && !equal(got, []string{"trigger", "after"}) {
+			t.Fatalf("mode %d: got %v", mode, got)
+		}
+		recovered := map[interface{}]bool{}
+		for i := 0; i < 2; i++ {
+			recovered[<-panics] = true
+		}
+		if !recovered["middleware"] || !recovered["trigger"] {
+			t.Fatalf("mode %d: recovered %v", mode, recovered)
+		}
+	}
+}
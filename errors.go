@@ -0,0 +1,88 @@
+package kitty
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Registration failures, use errors.Is on the error returned by RunContext
+var (
+	// The nick and all the alternatives are taken (433, 436)
+	ErrNickInUse = errors.New("kitty: nickname is already in use")
+	// The server doesn't accept the nick or any of the alternatives (432)
+	ErrBadNick = errors.New("kitty: erroneous nickname")
+	// SASL authentication failed (904, 905), see SASLError
+	ErrSASLFailed = errors.New("kitty: sasl authentication failed")
+	// The server password is wrong (464)
+	ErrBadPassword = errors.New("kitty: bad server password")
+	// We are banned from the server (465)
+	ErrBanned = errors.New("kitty: banned from the server")
+	// The server didn't welcome us within RegistrationTimeout
+	ErrRegistrationTimeout = errors.New("kitty: registration timed out")
+)
+
+// ErrHijackSSL is returned when HijackSession is set on an SSL connection,
+// an SSL session can't be handed over
+var ErrHijackSSL = errors.New("kitty: can't hijack an ssl connection")
+
+// RegistrationError is the error the bot closes with
+// when the server refuses to register it
+type RegistrationError struct {
+	// The numeric reply, like 433
+	Numeric string
+	Message string
+	// One of the Err* registration errors
+	Err error
+}
+
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("kitty: registration failed (%s): %s", e.Numeric, e.Message)
+}
+
+// Unwrap returns e.Err
+func (e *RegistrationError) Unwrap() error {
+	return e.Err
+}
+
+// Unwrap returns ErrSASLFailed
+func (e *SASLError) Unwrap() error {
+	return ErrSASLFailed
+}
+
+// retryable reports whether reconnecting could fix the error
+func retryable(err error) bool {
+	return !errors.Is(err, ErrBadPassword) &&
+		!errors.Is(err, ErrBadNick) &&
+		!errors.Is(err, ErrBanned) &&
+		!errors.Is(err, ErrSASLFailed)
+}
+
+// Query failures, use errors.Is on the error returned by Whois and the other queries
+var (
+	// The nick isn't online (401)
+	ErrNoSuchNick = errors.New("kitty: no such nick")
+	// The channel doesn't exist (403)
+	ErrNoSuchChannel = errors.New("kitty: no such channel")
+)
+
+// QueryError is returned when the server answers a query with an error numeric
+type QueryError struct {
+	// The numeric reply, like 401
+	Numeric string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("kitty: query failed (%s): %s", e.Numeric, e.Message)
+}
+
+// Unwrap returns ErrNoSuchNick or ErrNoSuchChannel where they apply
+func (e *QueryError) Unwrap() error {
+	switch e.Numeric {
+	case "401":
+		return ErrNoSuchNick
+	case "403":
+		return ErrNoSuchChannel
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// register runs the bot until the server gives up on it
+func register(t *testing.T, srv *kittytest.Server, options ...func(*Bot)) error {
+	t.Helper()
+	options = append([]func(*Bot){func(bot *Bot) { bot.ThrottleDelay = 0 }}, options...)
+	bot := NewBot(srv.Addr(), "kittybot", options...)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := bot.RunContext(ctx)
+	return err
+}
+
+func TestBadPassword(t *testing.T) {
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.Password = "right"
+	})
+	err := register(t, srv, func(bot *Bot) {
+		bot.Password = "wrong"
+	})
+	var regErr *RegistrationError
+	if !errors.Is(err, ErrBadPassword) || !errors.As(err, &regErr) || regErr.Numeric != "464" {
+		t.Fatalf("got %v, want ErrBadPassword from a 464", err)
+	}
+	if retryable(err) {
+		t.Fatal("a bad password is retryable")
+	}
+}
+
+func TestBanned(t *testing.T) {
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+			if m.Command == "USER" {
+				c.Send(":irc.test 465 * :You are banned from this server")
+				c.Send("ERROR :Closing link")
+				return true
+			}
+			return false
+		}
+	})
+	err := register(t, srv)
+	var regErr *RegistrationError
+	if !errors.Is(err, ErrBanned) || !errors.As(err, &regErr) || regErr.Numeric != "465" {
+		t.Fatalf("got %v, want ErrBanned from a 465", err)
+	}
+	// RunForever doesn't retry a ban
+	bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+		bot.ThrottleDelay = 0
+		bot.Reconnect.MinDelay = time.Millisecond
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := bot.RunForever(ctx); !errors.Is(err, ErrBanned) {
+		t.Fatalf("RunForever: got %v, want ErrBanned", err)
+	}
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	// The server never welcomes us
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+			return m.Command == "USER"
+		}
+	})
+	start := time.Now()
+	err := register(t, srv, func(bot *Bot) {
+		bot.RegistrationTimeout = 100 * time.Millisecond
+	})
+	if !errors.Is(err, ErrRegistrationTimeout) {
+		t.Fatalf("got %v, want ErrRegistrationTimeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timed out after %v", time.Since(start))
+	}
+}
@@ -24,7 +24,26 @@ func main() {
 	}
 	bot := kitty.NewBot(*serv, *nick, hijackSession, channels)
 
-	bot.AddTrigger(sayInfoMessage)
+	router := kitty.NewRouter("-")
+	router.Addressed = true
+	router.Add(kitty.Command{
+		Name: "info",
+		Help: "says hello",
+		Action: func(bot *kitty.Bot, m *kitty.Message, args []string) {
+			bot.Reply(m, "Hello")
+		},
+	})
+	router.Add(kitty.Command{
+		Name:     "echo",
+		Aliases:  []string{"say"},
+		Help:     "repeats the text",
+		Args:     []kitty.Arg{{Name: "text", Rest: true}},
+		Cooldown: 5 * time.Second,
+		Action: func(bot *kitty.Bot, m *kitty.Message, args []string) {
+			bot.Reply(m, args[0])
+		},
+	})
+	bot.AddTrigger(router)
 	bot.AddTrigger(longTrigger)
 	bot.Logger.SetHandler(log.StdoutHandler)
 	// logHandler := log.LvlFilterHandler(log.LvlInfo, log.StdoutHandler)
@@ -38,16 +57,6 @@ func main() {
 	fmt.Println("Bot shutting down.")
 }
 
-// This trigger replies Hello when you say hello
-var sayInfoMessage = kitty.Trigger{
-	Condition: func(bot *kitty.Bot, m *kitty.Message) bool {
-		return m.Command == "PRIVMSG" && m.Content == "-info"
-	},
-	Action: func(bot *kitty.Bot, m *kitty.Message) {
-		bot.Reply(m, "Hello")
-	},
-}
-
 // This trigger replies Hello when you say hello
 var longTrigger = kitty.Trigger{
 	Condition: func(bot *kitty.Bot, m *kitty.Message) bool {
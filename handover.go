@@ -0,0 +1,89 @@
+package kitty
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/ugjka/ircmsg"
+)
+
+// writeHandover sends what the next bot needs to carry on the session,
+// one line each: our prefix, enabled CAPs, our channels and CAP values
+func (bot *Bot) writeHandover(w io.Writer) error {
+	_, err := io.WriteString(w, bot.Prefix().String()+"\n")
+	if err != nil {
+		return err
+	}
+	c := bot.capHandler
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(c.capsEnabled); err != nil {
+		return err
+	}
+	if err := enc.Encode(bot.state.Channels()); err != nil {
+		return err
+	}
+	return enc.Encode(c.capValues)
+}
+
+// readHandover reads what writeHandover sent.
+// Older bots stop after the enabled CAPs or our channels
+func (bot *Bot) readHandover(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() {
+		return scanErr(sc)
+	}
+	prefix := ircmsg.ParsePrefix(sc.Text())
+	bot.prefixMu.Lock()
+	bot.prefix = prefix
+	bot.prefixKnown = true
+	bot.prefixMu.Unlock()
+	// The old bot may have been on a fallback nick
+	bot.mu.Lock()
+	bot.nick = prefix.Name
+	bot.mu.Unlock()
+	if !sc.Scan() {
+		return scanErr(sc)
+	}
+	caps := append([]byte(nil), sc.Bytes()...)
+	var channels, values []byte
+	if sc.Scan() {
+		channels = append(channels, sc.Bytes()...)
+	}
+	if sc.Scan() {
+		values = append(values, sc.Bytes()...)
+	}
+	if sc.Err() != nil {
+		return sc.Err()
+	}
+	c := bot.capHandler
+	c.mu.Lock()
+	// The old bot finished negotiating long ago
+	c.done = true
+	err := json.Unmarshal(caps, &c.capsEnabled)
+	if err == nil && values != nil {
+		err = json.Unmarshal(values, &c.capValues)
+	}
+	c.mu.Unlock()
+	if err != nil || channels == nil {
+		return err
+	}
+	var names []string
+	if err := json.Unmarshal(channels, &names); err != nil {
+		return err
+	}
+	// Members, topics and modes are fetched again after the hijack
+	for _, name := range names {
+		bot.state.addChannel(name)
+	}
+	return nil
+}
+
+func scanErr(sc *bufio.Scanner) error {
+	if sc.Err() != nil {
+		return sc.Err()
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,105 @@
+package kitty
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandoverNegotiated(t *testing.T) {
+	negotiated := make(chan CapResult, 1)
+	bot := NewBot("irc.test:6667", "kittybot", func(bot *Bot) {
+		bot.CapsNegotiated = func(bot *Bot, result CapResult) {
+			negotiated <- result
+		}
+	})
+	bot.capHandler.reset()
+	err := bot.readHandover(strings.NewReader("kittybot!kitty@host\n{\"message-tags\":true}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Caps enabled later in the session don't end negotiation again
+	bot.capHandler.Handle(bot, privmsg(":irc.test CAP kittybot ACK :away-notify"))
+	select {
+	case <-negotiated:
+		t.Fatal("CapsNegotiated fired after a hand-over")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if enabled, _ := bot.CapStatus("away-notify"); !enabled {
+		t.Fatal("away-notify not enabled")
+	}
+}
+
+func TestHandoverRoundTrip(t *testing.T) {
+	old := NewBot("irc.test:6667", "kittybot")
+	old.capHandler.reset()
+	old.PrefixChange("kitty_", "kitty", "cat.example")
+	old.capHandler.capsEnabled["message-tags"] = true
+	old.capHandler.capsEnabled["sasl"] = false
+	old.capHandler.capValues["sasl"] = "PLAIN,EXTERNAL"
+	old.state.addChannel("#cats")
+	old.state.addChannel("#dogs")
+	var buf strings.Builder
+	if err := old.writeHandover(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.capHandler.reset()
+	if err := bot.readHandover(strings.NewReader(buf.String())); err != nil {
+		t.Fatal(err)
+	}
+	if p := bot.Prefix(); p.Name != "kitty_" || p.User != "kitty" || p.Host != "cat.example" {
+		t.Fatalf("prefix is %s", p)
+	}
+	if nick := bot.getNick(); nick != "kitty_" {
+		t.Fatalf("nick is %q", nick)
+	}
+	if enabled, present := bot.CapStatus("message-tags"); !enabled || !present {
+		t.Fatal("message-tags not enabled")
+	}
+	if enabled, present := bot.CapStatus("sasl"); enabled || !present {
+		t.Fatal("sasl enabled")
+	}
+	if v, _ := bot.CapValue("sasl"); v != "PLAIN,EXTERNAL" {
+		t.Fatalf("sasl value is %q", v)
+	}
+	for _, name := range []string{"#cats", "#dogs"} {
+		if _, ok := bot.State().Channel(name); !ok {
+			t.Fatalf("not on %s", name)
+		}
+	}
+}
+
+func TestHandoverOld(t *testing.T) {
+	tests := []struct {
+		name     string
+		handover string
+		channels int
+	}{
+		{"prefix and caps", "kitty_!kitty@cat.example\n{\"message-tags\":true}\n", 0},
+		{"and channels", "kitty_!kitty@cat.example\n{\"message-tags\":true}\n[\"#cats\"]\n", 1},
+	}
+	for _, tt := range tests {
+		bot := NewBot("irc.test:6667", "kittybot")
+		bot.capHandler.reset()
+		if err := bot.readHandover(strings.NewReader(tt.handover)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if nick := bot.getNick(); nick != "kitty_" {
+			t.Fatalf("%s: nick is %q", tt.name, nick)
+		}
+		if enabled, _ := bot.CapStatus("message-tags"); !enabled {
+			t.Fatalf("%s: message-tags not enabled", tt.name)
+		}
+		if n := len(bot.State().Channels()); n != tt.channels {
+			t.Fatalf("%s: on %d channels, want %d", tt.name, n, tt.channels)
+		}
+	}
+	// The caps line is required
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.capHandler.reset()
+	if err := bot.readHandover(strings.NewReader("kitty_!kitty@cat.example\n")); err == nil {
+		t.Fatal("hand-over without caps accepted")
+	}
+}
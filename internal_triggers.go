@@ -50,7 +50,7 @@ var joinChannels = Trigger{
 // Get bot's prefix by catching its own join
 var getPrefix = Trigger{
 	Condition: func(bot *Bot, m *Message) bool {
-		return m.Command == "JOIN" && m.Name == bot.getNick()
+		return m.Command == "JOIN" && bot.EqualFold(m.Name, bot.getNick())
 	},
 	Action: func(bot *Bot, m *Message) {
 		bot.prefixMu.Lock()
@@ -59,6 +59,7 @@ var getPrefix = Trigger{
 			User: m.Prefix.User,
 			Host: m.Prefix.Host,
 		}
+		bot.prefixKnown = true
 		bot.prefixMu.Unlock()
 		bot.Debug("got prefix", "prefix", bot.Prefix().String())
 	},
@@ -67,7 +68,7 @@ var getPrefix = Trigger{
 // Track nick changes internally so we can adjust the bot's prefix
 var setNick = Trigger{
 	Condition: func(bot *Bot, m *Message) bool {
-		return m.Command == "NICK" && m.From == bot.getNick()
+		return m.Command == "NICK" && bot.EqualFold(m.From, bot.getNick())
 	},
 	Action: func(bot *Bot, m *Message) {
 		bot.mu.Lock()
@@ -78,6 +79,30 @@ var setNick = Trigger{
 	},
 }
 
+// Mark the bot registered when the server welcomes us,
+// the welcome is addressed to the nick we ended up with
+var welcome = Trigger{
+	Condition: func(bot *Bot, m *Message) bool {
+		return m.Command == "001"
+	},
+	Action: func(bot *Bot, m *Message) {
+		bot.mu.Lock()
+		bot.registered = true
+		if m.To != "" {
+			bot.nick = m.To
+		}
+		afterWelcome := bot.afterWelcome
+		bot.afterWelcome = nil
+		bot.mu.Unlock()
+		if afterWelcome != nil {
+			go afterWelcome()
+		}
+		if m.To != "" {
+			bot.PrefixChange(m.To, "", "")
+		}
+	},
+}
+
 // Throw errors on invalid nick changes
 var nickError = Trigger{
 	Condition: func(bot *Bot, m *Message) bool {
@@ -114,5 +139,24 @@ var passwdFail = Trigger{
 	},
 	Action: func(bot *Bot, m *Message) {
 		bot.Crit("passwd fail", "error", m.Content)
+		bot.close("register", &RegistrationError{
+			Numeric: m.Command,
+			Message: m.Content,
+			Err:     ErrBadPassword,
+		})
+	},
+}
+
+var bannedFail = Trigger{
+	Condition: func(bot *Bot, m *Message) bool {
+		return m.Command == "465"
+	},
+	Action: func(bot *Bot, m *Message) {
+		bot.Crit("banned", "error", m.Content)
+		bot.close("register", &RegistrationError{
+			Numeric: m.Command,
+			Message: m.Content,
+			Err:     ErrBanned,
+		})
 	},
 }
@@ -1,20 +1,33 @@
 package kitty
 
 import (
-	"bytes"
 	"encoding/base64"
 	"strings"
 	"sync"
 )
 
 type ircCaps struct {
-	saslOn      bool
-	saslUser    string
-	saslPass    string
-	caps        []string
+	saslOn   bool
+	saslUser string
+	saslPass string
+	// SASL mechanism in use
+	sasl SASLMechanism
+	// Accumulates chunked AUTHENTICATE challenges
+	authBuf string
+	// Offered capabilities, true once ACKed
 	capsEnabled map[string]bool
-	mu          sync.Mutex
-	done        bool
+	// Values of the offered capabilities, like sasl=PLAIN,EXTERNAL
+	capValues map[string]string
+	// Accumulates multi-line CAP LS replies
+	lsBuf []string
+	// Number of CAP REQs waiting for ACK or NAK
+	pending int
+	// What happened to our requests during registration
+	acked []string
+	naked []string
+	mu    sync.Mutex
+	// Set once registration time negotiation has ended with CAP END
+	done bool
 }
 
 func (c *ircCaps) saslEnable() {
@@ -33,89 +46,336 @@ func (c *ircCaps) saslCreds(user, pass string) {
 func (c *ircCaps) reset() {
 	c.mu.Lock()
 	c.saslOn = false
+	c.sasl = nil
+	c.authBuf = ""
 	c.done = false
-	c.caps = []string{}
+	c.pending = 0
+	c.lsBuf = nil
+	c.acked = nil
+	c.naked = nil
 	c.capsEnabled = make(map[string]bool)
+	c.capValues = make(map[string]string)
 	c.mu.Unlock()
 }
 
 func (c *ircCaps) isSaslAuth(m *Message) bool {
-	return (m.Command == "AUTHENTICATE" && m.Param(0) == "+")
+	return m.Command == "AUTHENTICATE" && c.sasl != nil
 }
 
 func (c *ircCaps) isSaslFinished(m *Message) bool {
-	return m.Command == "903" || m.Command == "904"
-}
-
-func (c *ircCaps) isCapLS(m *Message) bool {
-	return m.Command == "CAP" && m.Param(1) == "LS"
-}
-
-func (c *ircCaps) isCapACK(m *Message) bool {
-	return m.Command == "CAP" && m.Param(1) == "ACK"
+	switch m.Command {
+	case "902", "903", "904", "905", "906", "907":
+		return true
+	}
+	return false
 }
 
 func (c *ircCaps) Handle(bot *Bot, m *Message) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+
+	if m.Command == "CAP" {
+		switch m.Param(1) {
+		case "LS":
+			c.handleLS(bot, m)
+		case "ACK":
+			c.handleACK(bot, m)
+		case "NAK":
+			bot.Warn("ircv3", "rejected", m.Trailing())
+			if !c.done {
+				c.naked = append(c.naked, strings.Fields(m.Trailing())...)
+			}
+			c.reqAnswered(bot)
+		case "NEW":
+			bot.Info("ircv3", "new", m.Trailing())
+			c.request(bot, c.offered(bot, m.Trailing()))
+		case "DEL":
+			bot.Info("ircv3", "deleted", m.Trailing())
+			for _, cap := range strings.Fields(m.Trailing()) {
+				delete(c.capsEnabled, cap)
+				delete(c.capValues, cap)
+			}
+		}
+		return
+	}
+
 	if c.done {
 		return
 	}
 
-	if c.isCapLS(m) {
-		for _, cap := range strings.Split(m.Content, " ") {
-			if _, ok := allowedCAPs[cap]; ok {
-				c.capsEnabled[cap] = true
-				c.caps = append(c.caps, cap)
-			} else {
-				c.capsEnabled[cap] = false
-			}
+	if c.isSaslAuth(m) {
+		bot.Debug("got auth message")
+		c.authenticate(bot, m.Param(0))
+	}
+
+	// The server rejected our credentials, no point in going on
+	if m.Command == "904" || m.Command == "905" {
+		bot.close("sasl", &SASLError{
+			Mechanism: c.mechName(),
+			Numeric:   m.Command,
+			Message:   m.Trailing(),
+		})
+		return
+	}
+
+	// A server that skipped its proof doesn't get to say we are done
+	if m.Command == "903" {
+		if sc, ok := c.sasl.(saslCompleter); ok && !sc.Done() {
+			bot.close("sasl", &SASLError{
+				Mechanism: c.mechName(),
+				Numeric:   m.Command,
+				Message:   "success before the mechanism completed",
+			})
+			return
 		}
-		bot.Send("CAP REQ :" + strings.Join(c.caps, " "))
 	}
 
-	if c.isCapACK(m) {
-		bot.Info("ircv3", "capabilities", m.Content)
-		if c.saslOn && strings.Contains(m.Content, "sasl") {
-			bot.Debug("recieved sasl ack")
-			bot.Send("AUTHENTICATE PLAIN")
+	if c.isSaslFinished(m) {
+		c.end(bot)
+	}
+}
+
+// handleLS collects the, possibly multi-line, CAP LS reply and requests what we want
+func (c *ircCaps) handleLS(bot *Bot, m *Message) {
+	c.lsBuf = append(c.lsBuf, strings.Fields(m.Trailing())...)
+	// CAP * LS * :more caps follow
+	if len(m.Params) > 3 && m.Param(2) == "*" {
+		return
+	}
+	caps := strings.Join(c.lsBuf, " ")
+	c.lsBuf = nil
+	want := c.offered(bot, caps)
+	if c.done {
+		c.request(bot, want)
+		return
+	}
+	if len(want) == 0 {
+		c.finish(bot)
+		return
+	}
+	c.request(bot, want)
+}
+
+// offered records the offered capabilities with their values
+// and returns the ones we want that are not enabled yet
+func (c *ircCaps) offered(bot *Bot, caps string) (want []string) {
+	for _, cap := range strings.Fields(caps) {
+		split := strings.SplitN(cap, "=", 2)
+		name := split[0]
+		if len(split) == 2 {
+			c.capValues[name] = split[1]
 		} else {
-			if c.saslOn {
-				bot.Crit("sasl not supported")
+			c.capValues[name] = ""
+		}
+		if !c.capsEnabled[name] {
+			c.capsEnabled[name] = false
+			if bot.wantCap(name) {
+				want = append(want, name)
 			}
-			bot.Send("CAP END")
-			c.done = true
 		}
 	}
+	return want
+}
 
-	if c.isSaslAuth(m) {
-		bot.Debug("got auth message")
-		out := bytes.Join([][]byte{[]byte(c.saslUser), []byte(c.saslUser), []byte(c.saslPass)}, []byte{0})
-		encpass := base64.StdEncoding.EncodeToString(out)
-		bot.Send("AUTHENTICATE " + encpass)
+// request sends CAP REQ, split over several lines if needed
+func (c *ircCaps) request(bot *Bot, caps []string) {
+	for len(caps) > 0 {
+		var line []string
+		size := 0
+		for len(caps) > 0 && (size == 0 || size+len(caps[0]) < 400) {
+			line = append(line, caps[0])
+			size += len(caps[0]) + 1
+			caps = caps[1:]
+		}
+		c.pending++
+		bot.Send("CAP REQ :" + strings.Join(line, " "))
 	}
+}
 
-	if c.isSaslFinished(m) {
-		bot.Send("CAP END")
-		c.done = true
+func (c *ircCaps) handleACK(bot *Bot, m *Message) {
+	bot.Info("ircv3", "capabilities", m.Trailing())
+	for _, cap := range strings.Fields(m.Trailing()) {
+		if strings.HasPrefix(cap, "-") {
+			c.capsEnabled[cap[1:]] = false
+			continue
+		}
+		c.capsEnabled[cap] = true
+		if !c.done {
+			c.acked = append(c.acked, cap)
+		}
+	}
+	c.reqAnswered(bot)
+}
+
+// reqAnswered is called on ACK and NAK,
+// once all requests are answered we authenticate or end negotiation
+func (c *ircCaps) reqAnswered(bot *Bot) {
+	if c.pending > 0 {
+		c.pending--
+	}
+	if c.pending > 0 || c.done {
+		return
 	}
+	c.finish(bot)
+}
+
+// finish starts SASL if needed or ends negotiation
+func (c *ircCaps) finish(bot *Bot) {
+	if c.saslOn && c.capsEnabled[CapSASL] {
+		bot.Debug("recieved sasl ack")
+		c.sasl = c.chooseMech(bot)
+		if c.sasl != nil {
+			bot.Send("AUTHENTICATE " + c.sasl.Name())
+			return
+		}
+		bot.Crit("no usable sasl mechanism", "offered", c.capValues[CapSASL])
+		c.end(bot)
+		return
+	}
+	if c.saslOn {
+		bot.Crit("sasl not supported")
+	}
+	c.end(bot)
+}
+
+func (c *ircCaps) end(bot *Bot) {
+	if c.done {
+		return
+	}
+	bot.Send("CAP END")
+	c.done = true
+	if bot.CapsNegotiated != nil {
+		result := CapResult{
+			Acked: c.acked,
+			Naked: c.naked,
+		}
+		for _, cap := range bot.RequestCaps {
+			if _, ok := c.capsEnabled[cap]; !ok {
+				result.Missing = append(result.Missing, cap)
+			}
+		}
+		go bot.CapsNegotiated(bot, result)
+	}
+}
+
+// authenticate answers a, possibly chunked, server challenge
+func (c *ircCaps) authenticate(bot *Bot, chunk string) {
+	if chunk != "+" {
+		c.authBuf += chunk
+	}
+	// A full chunk means more is coming
+	if len(chunk) == 400 {
+		return
+	}
+	challenge, err := base64.StdEncoding.DecodeString(c.authBuf)
+	c.authBuf = ""
+	var response []byte
+	if err == nil {
+		response, err = c.sasl.Next(challenge)
+	}
+	if err != nil {
+		bot.Send("AUTHENTICATE *")
+		bot.close("sasl", &SASLError{Mechanism: c.mechName(), Message: err.Error()})
+		return
+	}
+	for _, line := range authenticateLines(response) {
+		bot.Send(line)
+	}
+}
+
+func (c *ircCaps) mechName() string {
+	if c.sasl == nil {
+		return ""
+	}
+	return c.sasl.Name()
+}
+
+// chooseMech returns Bot.SASLMechanism, the mechanism named by Bot.SASLMech or,
+// if both are empty, picks one from the ones the server offers
+func (c *ircCaps) chooseMech(bot *Bot) SASLMechanism {
+	if bot.SASLMechanism != nil {
+		return bot.SASLMechanism
+	}
+	if bot.SASLMech != "" {
+		return NewSASLMechanism(bot.SASLMech, c.saslUser, c.saslPass)
+	}
+	value := c.capValues[CapSASL]
+	offered := func(mech string) bool {
+		for _, m := range strings.Split(value, ",") {
+			if strings.EqualFold(m, mech) {
+				return true
+			}
+		}
+		return false
+	}
+	hasCert := len(bot.TLSConfig.Certificates) > 0 || bot.TLSConfig.GetClientCertificate != nil
+	// Servers without CAP 302 don't list their mechanisms, so try the old defaults
+	if value == "" {
+		if hasCert {
+			return NewSASLMechanism(SASLExternal, "", "")
+		}
+		return NewSASLMechanism(SASLPlain, c.saslUser, c.saslPass)
+	}
+	if hasCert && offered(SASLExternal) {
+		return NewSASLMechanism(SASLExternal, "", "")
+	}
+	if c.saslPass == "" {
+		return nil
+	}
+	for _, mech := range []string{SASLScramSHA256, SASLScramSHA1, SASLPlain} {
+		if offered(mech) {
+			return NewSASLMechanism(mech, c.saslUser, c.saslPass)
+		}
+	}
+	return nil
+}
+
+// CapResult reports the outcome of capability negotiation
+type CapResult struct {
+	// Capabilities the server enabled
+	Acked []string
+	// Capabilities the server refused
+	Naked []string
+	// Capabilities from Bot.RequestCaps the server doesn't offer
+	Missing []string
+}
+
+// wantCap reports whether we should request the capability
+func (bot *Bot) wantCap(cap string) bool {
+	for _, disabled := range bot.DisableCaps {
+		if disabled == cap {
+			return false
+		}
+	}
+	if _, ok := allowedCAPs[cap]; ok {
+		return true
+	}
+	for _, requested := range bot.RequestCaps {
+		if requested == cap {
+			return true
+		}
+	}
+	return false
 }
 
 // Capabilities we can deal with
 // without doing crazy things in the library
 var allowedCAPs = map[string]struct{}{
-	CapAccountNotify: {},
-	CapAwayNotify:    {},
-	CapExtendedJoin:  {},
-	CapSASL:          {},
-	CapChghost:       {},
-	CapInviteNotify:  {},
-	CapMultiPrefix:   {},
-	CapCapNotify:     {},
-	CapSetName:       {},
-	CapServerTime:    {},
-	CapAccountTag:    {},
-	CapMessageTags:   {},
+	CapAccountNotify:   {},
+	CapAwayNotify:      {},
+	CapExtendedJoin:    {},
+	CapSASL:            {},
+	CapChghost:         {},
+	CapInviteNotify:    {},
+	CapMultiPrefix:     {},
+	CapUserhostInNames: {},
+	CapCapNotify:       {},
+	CapSetName:         {},
+	CapServerTime:      {},
+	CapAccountTag:      {},
+	CapMessageTags:     {},
+	CapBatch:           {},
+	CapLabeledResponse: {},
 }
 
 // CapAccountNotify is account-notify CAP
@@ -162,3 +422,12 @@ const CapAccountTag = "account-tag"
 
 // CapMessageTags is message-tags CAP
 const CapMessageTags = "message-tags"
+
+// CapEchoMessage is echo-message CAP
+const CapEchoMessage = "echo-message"
+
+// CapBatch is batch CAP
+const CapBatch = "batch"
+
+// CapLabeledResponse is labeled-response CAP
+const CapLabeledResponse = "labeled-response"
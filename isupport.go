@@ -0,0 +1,224 @@
+package kitty
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ISupport holds the features the server advertises with RPL_ISUPPORT (005).
+// Accessors return the RFC defaults for tokens the server didn't send.
+// It is safe for concurrent use
+type ISupport struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func newISupport() *ISupport {
+	is := &ISupport{}
+	is.reset()
+	return is
+}
+
+func (is *ISupport) reset() {
+	is.mu.Lock()
+	is.tokens = make(map[string]string)
+	is.mu.Unlock()
+}
+
+// ISupport returns the server features parsed from RPL_ISUPPORT
+func (bot *Bot) ISupport() *ISupport {
+	return bot.isupport
+}
+
+// update parses the tokens of a 005 line, without the target and the trailing text
+func (is *ISupport) update(tokens []string) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for _, token := range tokens {
+		if strings.HasPrefix(token, "-") {
+			delete(is.tokens, strings.ToUpper(token[1:]))
+			continue
+		}
+		split := strings.SplitN(token, "=", 2)
+		key := strings.ToUpper(split[0])
+		if key == "" {
+			continue
+		}
+		var value string
+		if len(split) == 2 {
+			value = unescapeISupport(split[1])
+		}
+		is.tokens[key] = value
+	}
+}
+
+// Values can contain \xHH escapes
+func unescapeISupport(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if c, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Get returns the raw value of a token
+func (is *ISupport) Get(token string) (value string, ok bool) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	value, ok = is.tokens[strings.ToUpper(token)]
+	return
+}
+
+// Tokens returns a copy of all advertised tokens
+func (is *ISupport) Tokens() map[string]string {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	tokens := make(map[string]string, len(is.tokens))
+	for k, v := range is.tokens {
+		tokens[k] = v
+	}
+	return tokens
+}
+
+func (is *ISupport) getDefault(token, def string) string {
+	if value, ok := is.Get(token); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+func (is *ISupport) getInt(token string, def int) int {
+	value, ok := is.Get(token)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// ChanTypes returns the channel prefixes, default "#&"
+func (is *ISupport) ChanTypes() string {
+	return is.getDefault("CHANTYPES", "#&")
+}
+
+// StatusMsg returns the prefixes that can be put in front of a channel
+// to message only the users with that status, for example "@+"
+func (is *ISupport) StatusMsg() string {
+	value, _ := is.Get("STATUSMSG")
+	return value
+}
+
+// IsChannel reports whether the target is a channel
+func (is *ISupport) IsChannel(target string) bool {
+	if target == "" {
+		return false
+	}
+	target = strings.TrimLeft(target, is.StatusMsg())
+	return target != "" && strings.IndexByte(is.ChanTypes(), target[0]) >= 0
+}
+
+// Prefix returns the channel membership modes and
+// their corresponding prefix symbols, default "ov" and "@+"
+func (is *ISupport) Prefix() (modes, symbols string) {
+	value, ok := is.Get("PREFIX")
+	if !ok {
+		value = "(ov)@+"
+	}
+	if !strings.HasPrefix(value, "(") {
+		return "", ""
+	}
+	split := strings.SplitN(value[1:], ")", 2)
+	if len(split) != 2 || len(split[0]) != len(split[1]) {
+		return "ov", "@+"
+	}
+	return split[0], split[1]
+}
+
+// ChanModes returns the channel modes by type:
+// a are list modes, b always take a parameter,
+// c take a parameter when set and d never take one.
+// Default "beI", "k", "l", "imnpst"
+func (is *ISupport) ChanModes() (a, b, c, d string) {
+	split := strings.SplitN(is.getDefault("CHANMODES", "beI,k,l,imnpst"), ",", 4)
+	for len(split) < 4 {
+		split = append(split, "")
+	}
+	// Types past D are ignored
+	if i := strings.IndexByte(split[3], ','); i >= 0 {
+		split[3] = split[3][:i]
+	}
+	return split[0], split[1], split[2], split[3]
+}
+
+// NickLen returns the maximum nick length, default 9
+func (is *ISupport) NickLen() int {
+	return is.getInt("NICKLEN", 9)
+}
+
+// UserLen returns the maximum username length, default NickLen
+func (is *ISupport) UserLen() int {
+	return is.getInt("USERLEN", is.NickLen())
+}
+
+// TopicLen returns the maximum topic length, 0 if unknown
+func (is *ISupport) TopicLen() int {
+	return is.getInt("TOPICLEN", 0)
+}
+
+// CaseMapping returns the server's casemapping, default "rfc1459"
+func (is *ISupport) CaseMapping() string {
+	return strings.ToLower(is.getDefault("CASEMAPPING", "rfc1459"))
+}
+
+// Modes returns the maximum number of parameterized modes in one MODE command,
+// default 3, 0 means unlimited
+func (is *ISupport) Modes() int {
+	value, ok := is.Get("MODES")
+	if ok && value == "" {
+		return 0
+	}
+	return is.getInt("MODES", 3)
+}
+
+// TargMax returns the maximum number of targets for the command,
+// 0 means unlimited or unknown
+func (is *ISupport) TargMax(command string) int {
+	value, _ := is.Get("TARGMAX")
+	for _, pair := range strings.Split(value, ",") {
+		split := strings.SplitN(pair, ":", 2)
+		if len(split) == 2 && strings.EqualFold(split[0], command) {
+			n, _ := strconv.Atoi(split[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// LineLen returns the maximum line length including CR LF, default 512
+func (is *ISupport) LineLen() int {
+	n := is.getInt("LINELEN", 512)
+	if n < 512 {
+		return 512
+	}
+	return n
+}
+
+// Network returns the network name
+func (is *ISupport) Network() string {
+	value, _ := is.Get("NETWORK")
+	return value
+}
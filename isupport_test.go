@@ -0,0 +1,105 @@
+package kitty
+
+import "testing"
+
+func TestUnescapeISupport(t *testing.T) {
+	tests := map[string]string{
+		"plain":          "plain",
+		`Libera\x20Chat`: "Libera Chat",
+		`a\x3Db\x5Cc`:    `a=b\c`,
+		`bad\xZZ`:        `bad\xZZ`,
+		`short\x2`:       `short\x2`,
+		`end\x`:          `end\x`,
+		`\x41\x42`:       "AB",
+	}
+	for in, want := range tests {
+		if got := unescapeISupport(in); got != want {
+			t.Errorf("unescapeISupport(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestISupportUpdate(t *testing.T) {
+	is := newISupport()
+	is.update([]string{"network=Libera\\x20Chat", "EXCEPTS", "NICKLEN=16", "=bad"})
+	if is.Network() != "Libera Chat" {
+		t.Errorf("network is %q", is.Network())
+	}
+	if v, ok := is.Get("excepts"); !ok || v != "" {
+		t.Errorf("EXCEPTS is %q, %v", v, ok)
+	}
+	if is.NickLen() != 16 {
+		t.Errorf("nicklen is %d", is.NickLen())
+	}
+	if len(is.Tokens()) != 3 {
+		t.Errorf("tokens are %v", is.Tokens())
+	}
+	// A later 005 can take tokens back
+	is.update([]string{"-NICKLEN"})
+	if is.NickLen() != 9 {
+		t.Errorf("nicklen is %d after removal", is.NickLen())
+	}
+}
+
+func TestISupportPrefix(t *testing.T) {
+	tests := []struct {
+		token          string
+		modes, symbols string
+	}{
+		{"", "ov", "@+"},
+		{"PREFIX=(qaohv)~&@%+", "qaohv", "~&@%+"},
+		{"PREFIX=", "", ""},
+		{"PREFIX=(ov)@", "ov", "@+"},
+		{"PREFIX=ov", "", ""},
+	}
+	for _, tt := range tests {
+		is := newISupport()
+		if tt.token != "" {
+			is.update([]string{tt.token})
+		}
+		if modes, symbols := is.Prefix(); modes != tt.modes || symbols != tt.symbols {
+			t.Errorf("%q: got %q %q, want %q %q", tt.token, modes, symbols, tt.modes, tt.symbols)
+		}
+	}
+}
+
+func TestISupportChanModes(t *testing.T) {
+	tests := []struct {
+		token      string
+		a, b, c, d string
+	}{
+		{"", "beI", "k", "l", "imnpst"},
+		{"CHANMODES=eIbq,k,flj,CFLMPQScgimnprstuz", "eIbq", "k", "flj", "CFLMPQScgimnprstuz"},
+		{"CHANMODES=b,k", "b", "k", "", ""},
+		{"CHANMODES=b,k,l,imn,XYZ", "b", "k", "l", "imn"},
+	}
+	for _, tt := range tests {
+		is := newISupport()
+		if tt.token != "" {
+			is.update([]string{tt.token})
+		}
+		a, b, c, d := is.ChanModes()
+		if a != tt.a || b != tt.b || c != tt.c || d != tt.d {
+			t.Errorf("%q: got %q %q %q %q", tt.token, a, b, c, d)
+		}
+	}
+}
+
+func TestISupportLineLen(t *testing.T) {
+	tests := map[string]int{
+		"":             512,
+		"LINELEN=1024": 1024,
+		"LINELEN=256":  512,
+		"LINELEN=lots": 512,
+		"LINELEN":      512,
+	}
+	for token, want := range tests {
+		is := newISupport()
+		if token != "" {
+			is.update([]string{token})
+		}
+		if got := is.LineLen(); got != want {
+			t.Errorf("%q: got %d, want %d", token, got, want)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package kitty
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ugjka/ircmsg"
@@ -24,8 +27,19 @@ type Bot struct {
 	// This is set if we have been hijacked
 	hijacked bool
 	con      net.Conn
-	outgoing chan string
-	handlers []Handler
+	outgoing chan queuedLine
+	// Protocol traffic, sent before outgoing, see sendqueue.go
+	priority chan queuedLine
+	// Read locked while queueing, the writer locks it to fail what's left
+	queueMu sync.RWMutex
+	// Copy on write []*triggerEntry, see triggers.go
+	handlers   atomic.Value
+	handlersMu sync.Mutex
+	lastID     TriggerID
+	// Library handlers, they run in order before the triggers
+	internal   []Handler
+	middleware []Middleware
+	queues     workQueues
 	// -race complained a lot, we are thread safe now
 	mu sync.Mutex
 	// When did we start? Used for uptime
@@ -53,6 +67,12 @@ type Bot struct {
 	SASLNick      string
 	SASLPassword  string
 	HijackSession bool
+	// SASL mechanism by name, like SASLScramSHA256.
+	// If empty, EXTERNAL is used when TLSConfig has a client certificate
+	// and the server offers it, otherwise the best password based mechanism
+	SASLMech string
+	// Custom SASL mechanism, overrides SASLMech
+	SASLMechanism SASLMechanism
 	// Set it if long messages get truncated
 	// on the receiving end
 	MsgSafetyBuffer bool
@@ -66,15 +86,43 @@ type Bot struct {
 	Dial func(network, addr string) (net.Conn, error)
 	// An optional function that connects to an IRC server over a secured connection:
 	DialTLS func(network, addr string, tlsConf *tls.Config) (*tls.Conn, error)
-	// This bots nick
+	// This bots configured nick, see CurrentNick for the nick in use
 	Nick string
 	// Transient nick, that is used internally to track nick changes and calculate the prefix for the bot
 	nick string
+	// Nicks to try when Nick is taken during registration,
+	// after these Nick gets suffixed with underscores
+	AltNicks []string
+	// Keep trying to get Nick back after falling back to another nick (default true)
+	RegainNick bool
+	// NickServ command that frees Nick, "REGAIN" or "GHOST", empty to not use NickServ
+	NickServRegain string
+	// Password sent with NickServRegain, not needed when logged in with SASL
+	NickServPassword string
+	// Number of nicks tried during registration
+	nickAttempt int
+	// Set while we MONITOR our configured nick
+	monitoring bool
+	// Reply to CTCP VERSION (default "kittybot")
+	CTCPVersion string
+	// Reply to CTCP SOURCE (default "https://github.com/ugjka/kittybot")
+	CTCPSource string
+	// Rate limits CTCP replies, nil means no limit
+	CTCPLimiter *Limiter
+	// Custom CTCP commands, see HandleCTCP
+	ctcp map[string]CTCPFunc
 	// This bots realname
 	Realname string
 	// Duration to wait between sending of messages to avoid being
-	// kicked by the server for flooding (default 250ms)
+	// kicked by the server for flooding (default 300ms).
+	// It is the penalty each line costs, see ThrottleBurst
 	ThrottleDelay time.Duration
+	// Extra penalty per byte of a line
+	ThrottleByteCost time.Duration
+	// How much penalty can build up before we slow down,
+	// lines are sent without delay until then.
+	// Typical ircd rules are ThrottleDelay 2s, ThrottleByteCost 1s/120 and ThrottleBurst 10s
+	ThrottleBurst time.Duration
 	// Enable reply flood protection
 	LimitReplies bool
 	// Strip irc formatting from incoming messages
@@ -83,8 +131,50 @@ type Bot struct {
 	// default: 5 messages per 10 seconds
 	ReplyMessageLimit int
 	ReplyInterval     time.Duration
+	// Rate limits replies by who they answer, checked once per incoming
+	// message in Reply and its variants, nil means no limit
+	ReplyLimiter *Limiter
 	// Maxmimum time between incoming data
 	PingTimeout time.Duration
+	// How messages are handed to triggers (default DispatchConcurrent)
+	Dispatch DispatchMode
+	// Backoff policy used by RunForever
+	Reconnect ReconnectPolicy
+	// OnDisconnect fires in its own goroutine when RunForever loses the connection
+	OnDisconnect func(cause DisconnectCause)
+	// OnReconnect fires in its own goroutine when the server has welcomed
+	// the bot again after RunForever reconnected,
+	// attempt is the number of the successful attempt
+	OnReconnect func(attempt int, cause DisconnectCause)
+	// Why did the last connection end
+	cause DisconnectCause
+	// When did the current connection come up, used to detect a stable connection
+	connectedAt time.Time
+	// Fires once the server welcomes us, used by RunForever
+	afterWelcome func()
+	// Capabilities to request on top of the ones the library handles
+	RequestCaps []string
+	// Capabilities not to request, even if the library handles them
+	DisableCaps []string
+	// CapsNegotiated fires in its own goroutine when capability negotiation has ended
+	CapsNegotiated func(bot *Bot, result CapResult)
+	// OnHandlerPanic is called when a trigger or middleware panics,
+	// after the panic has been recovered and logged
+	OnHandlerPanic func(bot *Bot, m *Message, recovered interface{}, stack []byte)
+	// QUIT message sent when the bot is stopped by a context (default "bye")
+	QuitMessage string
+	// How long to wait for the outgoing queue to flush on QUIT (default 5s)
+	QuitTimeout time.Duration
+	// Give up if the server hasn't welcomed us in this time (default 1m), 0 waits forever
+	RegistrationTimeout time.Duration
+	// Set once the server has welcomed us
+	registered bool
+	// Closed when the connection goes down
+	done chan struct{}
+	// Set once we have started quitting
+	quitting bool
+	// Signals that QUIT has been written to the socket
+	quitSent chan struct{}
 
 	TLSConfig tls.Config
 	// Bot's prefix
@@ -92,6 +182,21 @@ type Bot struct {
 	prefixMu *sync.RWMutex
 	// rate limiter
 	limiter *rateLimiter
+	// Channel and user state
+	state *State
+	// Server features from 005
+	isupport *ISupport
+	// Set once we know our real prefix
+	prefixKnown bool
+	// Batch types whose messages skip the triggers,
+	// they only arrive whole through AddBatchTrigger
+	GroupBatches []string
+	// Open batches by reference, only used by the reader
+	batches map[string]*Batch
+	// How long Request waits when its context has no deadline (default 30s)
+	RequestTimeout time.Duration
+	// Pending requests
+	requests *requests
 }
 
 func (bot *Bot) String() string {
@@ -101,20 +206,13 @@ func (bot *Bot) String() string {
 // NewBot creates a new instance of Bot
 func NewBot(host, nick string, options ...func(*Bot)) *Bot {
 
-	// determine user for intial prefix
-	user := func() string {
-		if len(nick) > 9 {
-			return nick[:9]
-		}
-		return nick
-	}()
-
 	// Defaults are set here
 	bot := Bot{
 		started:         time.Now(),
 		unixastr:        fmt.Sprintf("@%s-%s/bot", host, nick),
 		unixsock:        fmt.Sprintf("/tmp/%s-%s-bot.sock", host, nick),
-		outgoing:        make(chan string, 16),
+		outgoing:        make(chan queuedLine, 16),
+		priority:        make(chan queuedLine, 64),
 		Host:            host,
 		Nick:            nick,
 		nick:            nick,
@@ -131,15 +229,34 @@ func NewBot(host, nick string, options ...func(*Bot)) *Bot {
 		Password:        "",
 		// Somewhat sane default if for some reason we can't retrieve bot's prefix
 		// for example, if the server doesn't advertise joins
-		prefix: &ircmsg.Prefix{
-			Name: nick,
-			User: user,
-			Host: strings.Repeat("*", 510-353-len(nick)-len(user)),
-		},
+		prefix:            defaultPrefix(nick, newISupport()),
 		prefixMu:          &sync.RWMutex{},
 		ReplyMessageLimit: 5,
 		ReplyInterval:     time.Second * 10,
+		QuitMessage:       "bye",
+		QuitTimeout:       5 * time.Second,
+		done:              make(chan struct{}),
+		quitSent:          make(chan struct{}, 1),
+		isupport:          newISupport(),
+		Reconnect: ReconnectPolicy{
+			MinDelay:    5 * time.Second,
+			MaxDelay:    5 * time.Minute,
+			Factor:      2,
+			Jitter:      0.2,
+			StableAfter: 5 * time.Minute,
+		},
+		RegistrationTimeout: time.Minute,
+		RegainNick:          true,
+		RequestTimeout:      30 * time.Second,
+		requests:            newRequests(),
+		CTCPVersion:         "kittybot",
+		CTCPSource:          "https://github.com/ugjka/kittybot",
+		CTCPLimiter: &Limiter{
+			User:   Limit{Messages: 3, Interval: 10 * time.Second},
+			Target: Limit{Messages: 5, Interval: 10 * time.Second},
+		},
 	}
+	bot.state = newState(bot.Casefold)
 	for _, option := range options {
 		option(&bot)
 	}
@@ -147,15 +264,23 @@ func NewBot(host, nick string, options ...func(*Bot)) *Bot {
 	bot.Logger = log.New()
 
 	bot.Logger.SetHandler(log.DiscardHandler())
-	bot.AddTrigger(pingPong)
-	bot.AddTrigger(joinChannels)
-	bot.AddTrigger(getPrefix)
-	bot.AddTrigger(setNick)
-	bot.AddTrigger(nickError)
-	bot.AddTrigger(bot.capHandler)
-	bot.AddTrigger(saslFail)
-	bot.AddTrigger(saslSuccess)
-	bot.AddTrigger(passwdFail)
+	bot.internal = []Handler{
+		pingPong,
+		joinChannels,
+		getPrefix,
+		setNick,
+		welcome,
+		nickError,
+		nickFallback,
+		regainNick,
+		bot.capHandler,
+		saslFail,
+		saslSuccess,
+		passwdFail,
+		bannedFail,
+		ctcpRequest,
+		bot.requests,
+	}
 	return &bot
 }
 
@@ -165,14 +290,14 @@ func (bot *Bot) saslAuthenticate(user, pass string) {
 	bot.capHandler.saslEnable()
 	bot.capHandler.saslCreds(user, pass)
 	bot.Debug("beginning sasl authentication")
-	bot.Send("CAP LS")
+	bot.Send("CAP LS 302")
 	bot.SetNick(bot.Nick)
 	bot.sendUserCommand(bot.Nick, bot.Realname, "0")
 }
 
 // standardRegistration performs a basic set of registration commands
 func (bot *Bot) standardRegistration() {
-	bot.Send("CAP LS")
+	bot.Send("CAP LS 302")
 	//Server registration
 	if bot.Password != "" {
 		bot.Send("PASS " + bot.Password)
@@ -187,6 +312,24 @@ func (bot *Bot) sendUserCommand(user, realname, mode string) {
 	bot.Send(fmt.Sprintf("USER %s %s * :%s", user, mode, realname))
 }
 
+// Placeholder prefix used until we learn the real one
+func defaultPrefix(nick string, is *ISupport) *ircmsg.Prefix {
+	// determine user for intial prefix
+	user := nick
+	if len(user) > is.UserLen() {
+		user = user[:is.UserLen()]
+	}
+	hostLen := is.LineLen() - 2 - 353 - len(nick) - len(user)
+	if hostLen < 0 {
+		hostLen = 0
+	}
+	return &ircmsg.Prefix{
+		Name: nick,
+		User: user,
+		Host: strings.Repeat("*", hostLen),
+	}
+}
+
 func (bot *Bot) getNick() string {
 	bot.mu.Lock()
 	defer bot.mu.Unlock()
@@ -204,12 +347,19 @@ func (bot *Bot) connect(host string) (err error) {
 		dialTLS = tls.Dial
 	}
 
+	var con net.Conn
 	if bot.SSL {
-		bot.con, err = dialTLS("tcp", host, &bot.TLSConfig)
+		con, err = dialTLS("tcp", host, &bot.TLSConfig)
 	} else {
-		bot.con, err = dial("tcp", host)
+		con, err = dial("tcp", host)
+	}
+	if err != nil {
+		return err
 	}
-	return err
+	bot.mu.Lock()
+	bot.con = con
+	bot.mu.Unlock()
+	return nil
 }
 
 // https://modern.ircdocs.horse/formatting.html#characters
@@ -229,13 +379,24 @@ func (bot *Bot) handleIncomingMessages() {
 			raw = stripReg.ReplaceAllString(raw, "")
 		}
 		msg := parseMessage(raw)
+		if msg == nil {
+			continue
+		}
 
 		bot.Debug(fmt.Sprintf("[incoming]-[%s]", bot.Host), "raw", scan.Text())
-		go func() {
-			for _, h := range bot.handlers {
-				go h.Handle(bot, msg)
+		// Server features and state are updated in order,
+		// before any handlers see the message
+		if msg.Command == "005" && len(msg.Params) > 2 {
+			bot.isupport.update(msg.Params[1 : len(msg.Params)-1])
+			bot.prefixMu.Lock()
+			if !bot.prefixKnown {
+				bot.prefix = defaultPrefix(bot.getNick(), bot.isupport)
 			}
-		}()
+			bot.prefixMu.Unlock()
+		}
+		bot.trackBatch(msg)
+		bot.state.update(bot, msg)
+		bot.dispatch(msg)
 	}
 	bot.close("incoming", scan.Err())
 }
@@ -245,30 +406,65 @@ func (bot *Bot) handleOutgoingMessages() {
 	defer bot.wg.Done()
 	ticker := time.NewTicker(time.Second * 30)
 	defer ticker.Stop()
+	done := bot.doneChan()
 	send := func(msg string) (err error) {
 		bot.Debug(fmt.Sprintf("[outgoing]-[%s]", bot.Host), "raw", msg)
 		_, err = fmt.Fprint(bot.con, msg+"\r\n")
 		return err
 	}
+	throttle := &throttle{
+		lineCost: bot.ThrottleDelay,
+		byteCost: bot.ThrottleByteCost,
+		burst:    bot.ThrottleBurst,
+	}
+	defer func() {
+		bot.queueMu.Lock()
+		bot.dropQueued()
+		bot.queueMu.Unlock()
+	}()
 	for {
+		var next queuedLine
+		// Protocol traffic first
 		select {
-		case msg, ok := <-bot.outgoing:
-			if !ok {
+		case next = <-bot.priority:
+		default:
+			select {
+			case <-done:
 				return
+			case next = <-bot.priority:
+			case next = <-bot.outgoing:
+			case <-ticker.C:
+				next.line = fmt.Sprintf("PING :%s", strings.Split(bot.Host, ":")[0])
 			}
-			err := send(msg)
-			if err != nil {
-				bot.close("outgoing", err)
-				return
+		}
+		msg := next.line
+		// Last line of defence against smuggled commands
+		if err := validateLine(msg); err != nil {
+			bot.Error("dropped invalid line", "line", msg)
+			next.delivery.resolve(err)
+			continue
+		}
+		err := send(msg)
+		next.delivery.resolve(err)
+		if err != nil {
+			bot.close("outgoing", err)
+			return
+		}
+		if strings.HasPrefix(msg, "QUIT") {
+			select {
+			case bot.quitSent <- struct{}{}:
+			default:
 			}
-		case <-ticker.C:
-			err := send(fmt.Sprintf("PING :%s", strings.Split(bot.Host, ":")[0]))
-			if err != nil {
-				bot.close("outgoing", err)
+		}
+		if wait := throttle.wait(msg); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
 				return
+			case <-timer.C:
 			}
 		}
-		time.Sleep(bot.ThrottleDelay)
 	}
 }
 
@@ -276,17 +472,43 @@ func (bot *Bot) handleOutgoingMessages() {
 // Returns true if we have been hijacked (if you loop over Run it might be wise to break on hijack
 // to avoid looping between 2 instances).
 func (bot *Bot) Run() (hijacked bool) {
+	return bot.run(context.Background())
+}
+
+// RunContext is like Run but stops the bot gracefully when ctx is cancelled,
+// see Quit. The returned error is ctx.Err() if the context was cancelled,
+// otherwise the error that brought the connection down, if any.
+// Registration failures can be told apart with errors.Is,
+// for example errors.Is(err, ErrNickInUse)
+func (bot *Bot) RunContext(ctx context.Context) (hijacked bool, err error) {
+	hijacked = bot.run(ctx)
+	if err := ctx.Err(); err != nil {
+		return hijacked, err
+	}
+	return hijacked, bot.getCause().Err
+}
+
+func (bot *Bot) run(ctx context.Context) (hijacked bool) {
 	bot.Debug("starting bot goroutines")
 	// Reset some things in case we re-run Run
 	bot.reset()
+	if ctx.Err() != nil {
+		bot.setCause("", ctx.Err())
+		return
+	}
 	// Attempt reconnection
 	var hijack bool
 	if bot.HijackSession {
 		if bot.SSL {
 			bot.Crit("can't hijack an ssl connection")
+			bot.setCause("hijack", ErrHijackSSL)
 			return
 		}
-		hijack = bot.hijackSession()
+		var err error
+		hijack, err = bot.hijackSession()
+		if err != nil {
+			bot.Error("hijack failed", "err", err)
+		}
 		bot.Debug("hijack", "did we?", hijack)
 	}
 
@@ -294,10 +516,14 @@ func (bot *Bot) Run() (hijacked bool) {
 		err := bot.connect(bot.Host)
 		if err != nil {
 			bot.Crit("connect error", "err", err.Error())
+			bot.setCause("connect", err)
 			return
 		}
 		bot.Info("connected successfully!")
 	}
+	bot.mu.Lock()
+	bot.connectedAt = time.Now()
+	bot.mu.Unlock()
 
 	// token bucket rate limiter for reply spam
 	if bot.LimitReplies {
@@ -310,12 +536,39 @@ func (bot *Bot) Run() (hijacked bool) {
 	bot.wg.Add(1)
 	go bot.handleOutgoingMessages()
 	bot.wg.Add(1)
-	go bot.startUnixListener()
+	go func() {
+		defer bot.wg.Done()
+		if err := bot.startUnixListener(); err != nil {
+			bot.Error("unix listener", "err", err)
+		}
+	}()
 
 	if hijack {
+		bot.mu.Lock()
+		bot.registered = true
+		afterWelcome := bot.afterWelcome
+		bot.afterWelcome = nil
+		bot.mu.Unlock()
+		// A hijacked session was welcomed long ago
+		if afterWelcome != nil {
+			go afterWelcome()
+		}
+		// Servers resend RPL_ISUPPORT in reply to VERSION
+		bot.Send("VERSION")
+		// Refill the state of the channels we were handed
+		for _, channel := range bot.state.Channels() {
+			bot.Send("NAMES " + channel)
+			bot.Send("TOPIC " + channel)
+			bot.Send("MODE " + channel)
+		}
 		go bot.HijackAfterFunc()
 	}
 
+	if !hijack && bot.RegistrationTimeout > 0 {
+		bot.wg.Add(1)
+		go bot.registrationTimeout()
+	}
+
 	// Only register on an initial connection
 	if !bot.reconnecting {
 		if bot.SASL {
@@ -334,7 +587,16 @@ func (bot *Bot) Run() (hijacked bool) {
 			bot.standardRegistration()
 		}
 	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			bot.Quit(bot.QuitMessage)
+		case <-stop:
+		}
+	}()
 	bot.wg.Wait()
+	close(stop)
 	if bot.limiter != nil {
 		bot.limiter.kill()
 	}
@@ -343,6 +605,27 @@ func (bot *Bot) Run() (hijacked bool) {
 
 }
 
+// registrationTimeout closes the connection
+// if the server doesn't welcome us in time
+func (bot *Bot) registrationTimeout() {
+	defer bot.wg.Done()
+	timer := time.NewTimer(bot.RegistrationTimeout)
+	defer timer.Stop()
+	select {
+	case <-bot.doneChan():
+	case <-timer.C:
+		if !bot.isRegistered() {
+			bot.close("register", ErrRegistrationTimeout)
+		}
+	}
+}
+
+func (bot *Bot) isRegistered() bool {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.registered
+}
+
 // CapStatus returns whether the server capability is enabled and present
 func (bot *Bot) CapStatus(cap string) (enabled, present bool) {
 	bot.capHandler.mu.Lock()
@@ -353,28 +636,83 @@ func (bot *Bot) CapStatus(cap string) (enabled, present bool) {
 	return false, false
 }
 
+// CapValue returns the value the server advertised for the capability,
+// for example "PLAIN,EXTERNAL" for sasl
+func (bot *Bot) CapValue(cap string) (value string, present bool) {
+	bot.capHandler.mu.Lock()
+	defer bot.capHandler.mu.Unlock()
+	value, present = bot.capHandler.capValues[cap]
+	return
+}
+
 // internal closer
 func (bot *Bot) close(fault string, err error) {
 	bot.closeOnce.Do(func() {
+		bot.setCause(fault, err)
 		if err != nil {
 			bot.Error(fault, "error", err)
 		}
-		if bot.unixlist != nil {
-			bot.unixlist.Close()
+		bot.mu.Lock()
+		unixlist, con := bot.unixlist, bot.con
+		bot.mu.Unlock()
+		if unixlist != nil {
+			unixlist.Close()
 		}
-		bot.con.Close()
-		select {
-		case bot.outgoing <- "PING":
-		default:
+		if con != nil {
+			con.Close()
 		}
+		close(bot.doneChan())
 	})
 }
 
-// Close closes the bot
+// Close closes the bot without sending QUIT
 func (bot *Bot) Close() {
 	bot.close("", nil)
 }
 
+// ErrClosed is returned when sending while the bot is not connected
+var ErrClosed = errors.New("kitty: bot is not connected")
+
+// ErrShuttingDown is returned when sending while the bot is quitting
+var ErrShuttingDown = errors.New("kitty: bot is shutting down")
+
+// Quit sends QUIT with the given reason, waits up to QuitTimeout
+// for the outgoing queue to flush and then closes the connection.
+// CR, LF and NUL in the reason are sent as spaces
+func (bot *Bot) Quit(reason string) {
+	bot.mu.Lock()
+	if bot.quitting {
+		bot.mu.Unlock()
+		return
+	}
+	bot.quitting = true
+	done := bot.done
+	bot.mu.Unlock()
+
+	bot.Info("quitting", "reason", reason)
+	ctx, cancel := context.WithTimeout(context.Background(), bot.QuitTimeout)
+	defer cancel()
+	err := bot.enqueue(ctx, done, queuedLine{line: "QUIT :" + stripLine(reason)})
+	switch err {
+	case nil:
+		select {
+		case <-bot.quitSent:
+		case <-done:
+		case <-ctx.Done():
+			bot.Warn("quit timeout, outgoing queue not flushed")
+		}
+	case context.DeadlineExceeded:
+		bot.Warn("quit timeout, outgoing queue is full")
+	}
+	bot.close("", nil)
+}
+
+func (bot *Bot) doneChan() chan struct{} {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.done
+}
+
 // Prefix returns the bot's own prefix.
 // Can be useful if for example you want to
 // make an emoji wall that fits into one message perfectly
@@ -420,6 +758,27 @@ func SaslAuth(pass string) func(*Bot) {
 	}
 }
 
+// SaslExternal enables SASL EXTERNAL authentication over TLS,
+// load the client certificate with LoadClientCert
+func SaslExternal() func(*Bot) {
+	return func(bot *Bot) {
+		bot.SASL = true
+		bot.SSL = true
+		bot.SASLMech = SASLExternal
+	}
+}
+
+// LoadClientCert loads a PEM encoded client certificate and key
+// into TLSConfig, for SASL EXTERNAL or CertFP
+func (bot *Bot) LoadClientCert(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	bot.TLSConfig.Certificates = append(bot.TLSConfig.Certificates, cert)
+	return nil
+}
+
 // Uptime returns the uptime of the bot
 func (bot *Bot) Uptime() string {
 	return fmt.Sprintf("Started: %s, Uptime: %s", bot.started, time.Since(bot.started))
@@ -430,11 +789,33 @@ func (bot *Bot) reset() {
 	bot.mu.Lock()
 	bot.joinOnce = sync.Once{}
 	bot.closeOnce = sync.Once{}
+	bot.nick = bot.Nick
+	bot.cause = DisconnectCause{}
+	bot.connectedAt = time.Time{}
+	bot.done = make(chan struct{})
+	bot.quitting = false
+	bot.registered = false
+	bot.nickAttempt = 0
+	bot.monitoring = false
 	bot.mu.Unlock()
+	bot.isupport.reset()
+	bot.prefixMu.Lock()
+	bot.prefix = defaultPrefix(bot.Nick, bot.isupport)
+	bot.prefixKnown = false
+	bot.prefixMu.Unlock()
 	bot.wg = sync.WaitGroup{}
 	bot.hijacked = false
 	bot.reconnecting = false
 	bot.capHandler.reset()
+	bot.state.clear()
+	bot.batches = make(map[string]*Batch)
+	bot.requests.reset()
+	// Drop whatever was queued for the previous connection
+	bot.dropQueued()
+	select {
+	case <-bot.quitSent:
+	default:
+	}
 }
 
 // Handler is used to subscribe and react to events on the bot Server
@@ -452,11 +833,6 @@ type Trigger struct {
 	Action func(*Bot, *Message)
 }
 
-// AddTrigger adds a trigger to the bot's handlers
-func (bot *Bot) AddTrigger(h Handler) {
-	bot.handlers = append(bot.handlers, h)
-}
-
 // Handle executes the trigger action if the condition is satisfied
 func (t Trigger) Handle(bot *Bot, m *Message) {
 	if t.Condition(bot, m) {
@@ -483,6 +859,22 @@ type Message struct {
 	// Nick of the messages sender (equivalent to Prefix.Name)
 	// Outdated, please use .Name
 	From string
+
+	// CTCP command of a PRIVMSG or NOTICE, like "VERSION", empty if it is not CTCP
+	CTCP string
+	// Arguments of the CTCP command
+	CTCPArgs string
+
+	// Reference and type of the batch the message is part of, empty outside batches
+	BatchRef  string
+	BatchType string
+	// Set on the BATCH line that ends a top level batch
+	Completed *Batch
+
+	// Set by StopPropagation
+	stopped int32
+	// Part of a batch in GroupBatches
+	grouped bool
 }
 
 // parseMessage takes a string and attempts to create a Message struct.
@@ -490,6 +882,9 @@ type Message struct {
 func parseMessage(raw string) (m *Message) {
 	m = new(Message)
 	m.Message = ircmsg.ParseMessage(raw)
+	if m.Message == nil {
+		return nil
+	}
 	m.Content = m.Trailing()
 
 	if len(m.Params) > 0 {
@@ -500,6 +895,7 @@ func parseMessage(raw string) (m *Message) {
 	if m.Prefix != nil {
 		m.From = m.Prefix.Name
 	}
+	m.parseCTCP()
 	m.TimeStamp = time.Now()
 
 	m.Raw = raw
@@ -0,0 +1,319 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// newServer starts a fake server that is closed after the test
+func newServer(t *testing.T, configure ...func(*kittytest.Server)) *kittytest.Server {
+	t.Helper()
+	srv := kittytest.NewUnstartedServer()
+	for _, f := range configure {
+		f(srv)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startBot runs a bot against the server and waits for it to register
+func startBot(t *testing.T, srv *kittytest.Server, options ...func(*Bot)) (*Bot, *kittytest.Client) {
+	t.Helper()
+	options = append([]func(*Bot){func(bot *Bot) { bot.ThrottleDelay = 0 }}, options...)
+	bot := NewBot(srv.Addr(), "kittybot", options...)
+	done := make(chan struct{})
+	go func() {
+		bot.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		bot.Close()
+		<-done
+	})
+	c, err := srv.NextClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitRegistered(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return bot, c
+}
+
+// waitFor polls until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	for _, pattern := range []string{`^CAP LS 302$`, `^CAP END$`, `^JOIN #test$`} {
+		if _, err := c.Expect(time.Second, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := strings.Join(c.Lines(), "\n")
+	for _, line := range []string{"NICK kittybot", "USER kittybot 0 * :kittybot"} {
+		if !strings.Contains(sent, line) {
+			t.Fatalf("%q not sent", line)
+		}
+	}
+	if c.Nick() != "kittybot" || bot.CurrentNick() != "kittybot" {
+		t.Fatalf("nick is %q on the server and %q in the bot", c.Nick(), bot.CurrentNick())
+	}
+	waitFor(t, "the join", func() bool { return bot.State().IsOn("#test", "kittybot") })
+}
+
+func TestCapMultilineLS(t *testing.T) {
+	srv := newServer(t, func(srv *kittytest.Server) {
+		// Sorted ahead of the caps we want, which end up on the last lines
+		for i := 0; i < 40; i++ {
+			srv.Caps[fmt.Sprintf("aaa/cap-%02d", i)] = "some-value"
+		}
+	})
+	bot, c := startBot(t, srv)
+	var requests int
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, "CAP REQ") && strings.Contains(line, CapUserhostInNames) {
+			requests++
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("requested userhost-in-names %d times, want once", requests)
+	}
+	for _, cap := range []string{CapMultiPrefix, CapUserhostInNames} {
+		if enabled, _ := bot.CapStatus(cap); !enabled {
+			t.Fatalf("%s from the last LS line is not enabled", cap)
+		}
+	}
+	if value, _ := bot.CapValue("aaa/cap-00"); value != "some-value" {
+		t.Fatalf("cap value from the first LS line is %q", value)
+	}
+}
+
+func TestCapNAK(t *testing.T) {
+	srv := newServer(t)
+	srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+		if m.Command == "CAP" && m.Param(0) == "REQ" && strings.Contains(m.Trailing(), CapAwayNotify) {
+			c.Send(":irc.test CAP * NAK :" + m.Trailing())
+			return true
+		}
+		return false
+	}
+	bot, c := startBot(t, srv)
+	if _, err := c.Expect(time.Second, `^CAP END$`); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, present := bot.CapStatus(CapAwayNotify); enabled || !present {
+		t.Fatalf("away-notify enabled %v present %v, want offered but not enabled", enabled, present)
+	}
+}
+
+func TestCapNewDel(t *testing.T) {
+	srv := newServer(t)
+	srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+		if m.Command == "CAP" && m.Param(0) == "REQ" && m.Trailing() == CapInviteNotify {
+			c.Send(":irc.test CAP kittybot ACK :" + CapInviteNotify)
+			return true
+		}
+		return false
+	}
+	bot, c := startBot(t, srv)
+	if _, present := bot.CapStatus(CapInviteNotify); present {
+		t.Fatal("invite-notify present before CAP NEW")
+	}
+	c.Send(":irc.test CAP kittybot NEW :" + CapInviteNotify)
+	if _, err := c.Expect(time.Second, `^CAP REQ :invite-notify$`); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "invite-notify", func() bool {
+		enabled, _ := bot.CapStatus(CapInviteNotify)
+		return enabled
+	})
+	c.Send(":irc.test CAP kittybot DEL :" + CapInviteNotify)
+	waitFor(t, "invite-notify to go away", func() bool {
+		_, present := bot.CapStatus(CapInviteNotify)
+		return !present
+	})
+}
+
+func TestRequestCaps(t *testing.T) {
+	srv := newServer(t, func(srv *kittytest.Server) {
+		for i := 0; i < 40; i++ {
+			srv.Caps[fmt.Sprintf("vendor/cap-%02d", i)] = "some-value"
+		}
+		srv.Caps["zzz/last"] = ""
+	})
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.RequestCaps = []string{"zzz/last"}
+		bot.DisableCaps = []string{CapAwayNotify}
+	})
+	var requests int
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, "CAP REQ") && strings.Contains(line, "zzz/last") {
+			requests++
+		}
+		if strings.HasPrefix(line, "CAP REQ") && strings.Contains(line, CapAwayNotify) {
+			t.Fatalf("disabled cap requested: %q", line)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("requested zzz/last %d times, want once", requests)
+	}
+	if enabled, _ := bot.CapStatus("zzz/last"); !enabled {
+		t.Fatal("requested cap from the last LS line is not enabled")
+	}
+}
+
+func TestCapsNegotiated(t *testing.T) {
+	srv := newServer(t)
+	srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+		if m.Command == "CAP" && m.Param(0) == "REQ" && strings.Contains(m.Trailing(), CapAwayNotify) {
+			c.Send(":irc.test CAP * NAK :" + m.Trailing())
+			return true
+		}
+		return false
+	}
+	results := make(chan CapResult, 1)
+	startBot(t, srv, func(bot *Bot) {
+		bot.CapsNegotiated = func(bot *Bot, result CapResult) { results <- result }
+	})
+	var result CapResult
+	select {
+	case result = <-results:
+	case <-time.After(time.Second):
+		t.Fatal("CapsNegotiated didn't fire")
+	}
+	var naked bool
+	for _, cap := range result.Naked {
+		naked = naked || cap == CapAwayNotify
+	}
+	if !naked {
+		t.Fatalf("away-notify is not in %v", result.Naked)
+	}
+}
+
+// contextSends tries every *Context variant and returns their errors
+func contextSends(bot *Bot) map[string]error {
+	ctx := context.Background()
+	m := privmsg(":alice!a@h PRIVMSG #test :hi")
+	return map[string]error{
+		"SendContext":        bot.SendContext(ctx, "PRIVMSG #test :hi"),
+		"MsgContext":         bot.MsgContext(ctx, "#test", "hi"),
+		"NoticeContext":      bot.NoticeContext(ctx, "#test", "hi"),
+		"ReplyContext":       bot.ReplyContext(ctx, m, "hi"),
+		"ReplyThreadContext": bot.ReplyThreadContext(ctx, m, "hi"),
+		"SendMessage":        bot.SendMessage(ctx, OutMessage{Command: "PRIVMSG", Params: []string{"#test", "hi"}}),
+		"SendMessageAsync":   bot.SendMessageAsync(OutMessage{Command: "PRIVMSG", Params: []string{"#test", "hi"}}).Wait(ctx),
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	srv := newServer(t)
+	bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+		bot.ThrottleDelay = 20 * time.Millisecond
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		hijacked bool
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		hijacked, err := bot.RunContext(ctx)
+		results <- result{hijacked, err}
+	}()
+	c, err := srv.NextClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitRegistered(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		bot.Send(fmt.Sprintf("PRIVMSG #test :%d", i))
+	}
+	cancel()
+	// The queue is flushed before QUIT
+	for i := 0; i < 5; i++ {
+		if _, err := c.Expect(time.Second, fmt.Sprintf("^PRIVMSG #test :?%d$", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Expect(time.Second, `^QUIT :?bye$`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-results:
+		if r.hijacked || r.err != context.Canceled {
+			t.Fatalf("got %v, %v, want context.Canceled", r.hijacked, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunContext didn't return")
+	}
+	for name, err := range contextSends(bot) {
+		if err != ErrClosed {
+			t.Errorf("%s: got %v, want ErrClosed", name, err)
+		}
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.ThrottleDelay = 50 * time.Millisecond
+	})
+	for i := 0; i < 5; i++ {
+		bot.Send(fmt.Sprintf("PRIVMSG #test :%d", i))
+	}
+	quit := make(chan struct{})
+	go func() {
+		bot.Quit("later")
+		close(quit)
+	}()
+	waitFor(t, "quitting", func() bool {
+		bot.mu.Lock()
+		defer bot.mu.Unlock()
+		return bot.quitting
+	})
+	for name, err := range contextSends(bot) {
+		if !errors.Is(err, ErrShuttingDown) {
+			t.Errorf("%s: got %v, want ErrShuttingDown", name, err)
+		}
+	}
+	if _, err := c.Expect(2*time.Second, `^QUIT :?later$`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expect(0, `^PRIVMSG`); err == nil {
+		t.Fatal("sent a message after QUIT")
+	}
+	var sent int
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, "PRIVMSG #test") {
+			sent++
+		}
+	}
+	if sent != 5 {
+		t.Fatalf("%d of 5 messages sent before QUIT", sent)
+	}
+	<-quit
+}
@@ -0,0 +1,134 @@
+package kittytest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// The minimum iteration count RFC 7677 recommends
+const scramIterations = 4096
+
+// scramServer is the server side of a SCRAM exchange
+type scramServer struct {
+	hash     func() hash.Hash
+	accounts map[string]string
+
+	step        int
+	account     string
+	nonce       string
+	clientFirst string
+	serverFirst string
+	salted      []byte
+}
+
+func newScramServer(mech string, accounts map[string]string) *scramServer {
+	h := sha256.New
+	if mech == "SCRAM-SHA-1" {
+		h = sha1.New
+	}
+	return &scramServer{hash: h, accounts: accounts}
+}
+
+// next returns the challenge for the client's response,
+// account is set once the exchange has succeeded
+func (s *scramServer) next(response []byte) (challenge []byte, account string, err error) {
+	s.step++
+	switch s.step {
+	case 1:
+		msg := string(response)
+		if !strings.HasPrefix(msg, "n,,") {
+			return nil, "", errors.New("unsupported gs2 header")
+		}
+		s.clientFirst = msg[3:]
+		attrs := scramAttrs(s.clientFirst)
+		user := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+		pass, ok := s.accounts[user]
+		if !ok || attrs["r"] == "" {
+			return nil, "", errors.New("unknown account")
+		}
+		s.account = user
+		salt := make([]byte, 16)
+		nonce := make([]byte, 18)
+		rand.Read(salt)
+		rand.Read(nonce)
+		s.nonce = attrs["r"] + base64.RawStdEncoding.EncodeToString(nonce)
+		s.salted = pbkdf2(s.hash, []byte(pass), salt, scramIterations)
+		s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(scramIterations)
+		return []byte(s.serverFirst), "", nil
+	case 2:
+		msg := string(response)
+		i := strings.LastIndex(msg, ",p=")
+		if i < 0 {
+			return nil, "", errors.New("missing proof")
+		}
+		withoutProof := msg[:i]
+		attrs := scramAttrs(withoutProof)
+		if attrs["c"] != "biws" || attrs["r"] != s.nonce {
+			return nil, "", errors.New("bad channel binding or nonce")
+		}
+		proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+		if err != nil {
+			return nil, "", err
+		}
+		authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + withoutProof)
+		clientKey := hmacSum(s.hash, s.salted, []byte("Client Key"))
+		h := s.hash()
+		h.Write(clientKey)
+		sig := hmacSum(s.hash, h.Sum(nil), authMessage)
+		if len(proof) != len(sig) {
+			return nil, "", errors.New("bad proof")
+		}
+		for i := range sig {
+			sig[i] ^= proof[i]
+		}
+		if !hmac.Equal(sig, clientKey) {
+			return nil, "", errors.New("wrong password")
+		}
+		serverSig := hmacSum(s.hash, hmacSum(s.hash, s.salted, []byte("Server Key")), authMessage)
+		return []byte("v=" + base64.StdEncoding.EncodeToString(serverSig)), "", nil
+	case 3:
+		return nil, s.account, nil
+	}
+	return nil, "", errors.New("unexpected response")
+}
+
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 1 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func hmacSum(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := make([]byte, len(u))
+	copy(out, u)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
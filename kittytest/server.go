@@ -0,0 +1,812 @@
+// Package kittytest provides a scriptable fake IRC server for testing bots.
+//
+// The server speaks enough of the client protocol for a bot to register,
+// negotiate capabilities, authenticate with SASL PLAIN, EXTERNAL or SCRAM, join channels and list their members.
+// Tests inject lines with Client.Send and assert on what the bot sent with Client.Expect.
+package kittytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+)
+
+// ErrTimeout is returned when an expected event doesn't happen in time
+var ErrTimeout = errors.New("kittytest: timeout")
+
+// Server is a fake IRC server
+type Server struct {
+	// Server name used as the prefix of server messages (default "irc.test")
+	Name string
+	// Network name sent in RPL_ISUPPORT (default "TestNet")
+	Network string
+	// Capabilities offered in CAP LS with their values,
+	// nil offers the defaults from NewUnstartedServer
+	Caps map[string]string
+	// RPL_ISUPPORT tokens sent after registration
+	ISupport []string
+	// Server password, registration fails with 464 if it doesn't match
+	Password string
+	// Accounts for SASL PLAIN and SCRAM, account name to password
+	Accounts map[string]string
+	// Account that SASL EXTERNAL logs in to, empty rejects EXTERNAL
+	ExternalAccount string
+	// Handler sees every line a client sends before the built-in handling,
+	// return true to skip the built-in handling
+	Handler func(c *Client, m *ircmsg.Message) bool
+
+	listener net.Listener
+	mu       sync.Mutex
+	clients  []*Client
+	channels map[string]*channel
+	newConn  chan *Client
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+type channel struct {
+	name    string
+	topic   string
+	members map[*Client]string
+}
+
+// NewUnstartedServer returns a server that is not listening yet,
+// change its fields and then call Start, or use Dial without starting it
+func NewUnstartedServer() *Server {
+	return &Server{
+		Name:    "irc.test",
+		Network: "TestNet",
+		Caps: map[string]string{
+			"multi-prefix":      "",
+			"userhost-in-names": "",
+			"extended-join":     "",
+			"account-notify":    "",
+			"away-notify":       "",
+			"cap-notify":        "",
+			"message-tags":      "",
+			"server-time":       "",
+			"sasl":              "PLAIN,EXTERNAL,SCRAM-SHA-1,SCRAM-SHA-256",
+		},
+		ISupport: []string{"CHANTYPES=#&", "PREFIX=(ov)@+", "CHANMODES=beI,k,l,imnpst",
+			"CASEMAPPING=rfc1459", "NICKLEN=30"},
+		Accounts: make(map[string]string),
+		channels: make(map[string]*channel),
+		newConn:  make(chan *Client, 16),
+		closed:   make(chan struct{}),
+	}
+}
+
+// NewServer starts a server listening on a random localhost port
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	if err := s.Start(); err != nil {
+		panic(fmt.Sprintf("kittytest: failed to listen: %v", err))
+	}
+	return s
+}
+
+// Start starts listening on a random localhost port
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(con)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the host:port the server listens on, use it as the bot's host
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return "kittytest:6667"
+	}
+	return s.listener.Addr().String()
+}
+
+// Dial connects over net.Pipe, it can be used as Bot.Dial
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	select {
+	case <-s.closed:
+		return nil, errors.New("kittytest: server closed")
+	default:
+	}
+	client, server := net.Pipe()
+	s.serve(server)
+	return client, nil
+}
+
+// Close disconnects all clients and stops the server
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	close(s.closed)
+	clients := s.clients
+	s.mu.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for _, c := range clients {
+		c.Close()
+	}
+	s.wg.Wait()
+}
+
+// NextClient waits for the next client to connect
+func (s *Server) NextClient(timeout time.Duration) (*Client, error) {
+	select {
+	case c := <-s.newConn:
+		return c, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+func (s *Server) serve(con net.Conn) {
+	c := &Client{
+		srv:        s,
+		con:        con,
+		caps:       make(map[string]bool),
+		received:   sync.NewCond(&sync.Mutex{}),
+		closed:     make(chan struct{}),
+		registerCh: make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.clients = append(s.clients, c)
+	s.mu.Unlock()
+	select {
+	case s.newConn <- c:
+	default:
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		c.read()
+	}()
+}
+
+func (s *Server) findClient(nick string) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		if strings.EqualFold(c.Nick(), nick) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *Server) removeClient(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, cl := range s.clients {
+		if cl == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	for key, ch := range s.channels {
+		delete(ch.members, c)
+		if len(ch.members) == 0 {
+			delete(s.channels, key)
+		}
+	}
+}
+
+// Client is a connection to the fake server
+type Client struct {
+	srv *Server
+	con net.Conn
+
+	mu         sync.Mutex
+	nick       string
+	user       string
+	realname   string
+	account    string
+	password   string
+	registered bool
+	negotiate  bool
+	caps       map[string]bool
+	saslMech   string
+	saslBuf    string
+	scram      *scramServer
+
+	// Lines received from the client
+	received *sync.Cond
+	lines    []string
+	cursor   int
+	eof      bool
+
+	closeOnce  sync.Once
+	closed     chan struct{}
+	registerCh chan struct{}
+}
+
+// Nick returns the client's current nick
+func (c *Client) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// Account returns the account the client logged in to with SASL
+func (c *Client) Account() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.account
+}
+
+// Caps returns the capabilities the client has enabled
+func (c *Client) Caps() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var caps []string
+	for name := range c.caps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func (c *Client) prefix() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("%s!%s@kittytest", c.nick, c.user)
+}
+
+// Send sends a raw line to the client
+func (c *Client) Send(line string) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	c.con.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := fmt.Fprint(c.con, line+"\r\n")
+	return err
+}
+
+// Sendf formats and sends a raw line to the client
+func (c *Client) Sendf(format string, a ...interface{}) error {
+	return c.Send(fmt.Sprintf(format, a...))
+}
+
+// numeric sends a numeric reply addressed to the client
+func (c *Client) numeric(code string, params ...string) {
+	nick := c.Nick()
+	if nick == "" {
+		nick = "*"
+	}
+	c.Send(formatLine(":"+c.srv.Name, code, append([]string{nick}, params...)...))
+}
+
+// Close disconnects the client
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.con.Close()
+	})
+}
+
+// Lines returns all lines received from the client so far
+func (c *Client) Lines() []string {
+	c.received.L.Lock()
+	defer c.received.L.Unlock()
+	return append([]string(nil), c.lines...)
+}
+
+// Expect waits for a line from the client that matches the regular expression.
+// Lines before the match are skipped, the next Expect continues after the match
+func (c *Client) Expect(timeout time.Duration, pattern string) (*ircmsg.Message, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		c.received.L.Lock()
+		c.received.Broadcast()
+		c.received.L.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	c.received.L.Lock()
+	defer c.received.L.Unlock()
+	for {
+		for c.cursor < len(c.lines) {
+			line := c.lines[c.cursor]
+			c.cursor++
+			if re.MatchString(line) {
+				return ircmsg.ParseMessage(line), nil
+			}
+		}
+		if c.eof {
+			return nil, fmt.Errorf("kittytest: connection closed while waiting for %q", pattern)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w waiting for %q", ErrTimeout, pattern)
+		}
+		c.received.Wait()
+	}
+}
+
+// WaitRegistered waits until the client has completed registration
+func (c *Client) WaitRegistered(timeout time.Duration) error {
+	select {
+	case <-c.registerCh:
+		return nil
+	case <-c.closed:
+		return errors.New("kittytest: connection closed before registration")
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+func (c *Client) read() {
+	defer func() {
+		c.received.L.Lock()
+		c.eof = true
+		c.received.Broadcast()
+		c.received.L.Unlock()
+		c.srv.removeClient(c)
+		c.Close()
+	}()
+	sc := bufio.NewScanner(c.con)
+	for sc.Scan() {
+		line := sc.Text()
+		m := ircmsg.ParseMessage(line)
+		c.received.L.Lock()
+		c.lines = append(c.lines, line)
+		c.received.Broadcast()
+		c.received.L.Unlock()
+		if m == nil {
+			continue
+		}
+		if c.srv.Handler != nil && c.srv.Handler(c, m) {
+			continue
+		}
+		if !c.handle(m) {
+			return
+		}
+	}
+}
+
+// handle implements the built-in commands, returns false to disconnect
+func (c *Client) handle(m *ircmsg.Message) bool {
+	s := c.srv
+	switch m.Command {
+	case "CAP":
+		c.handleCap(m)
+	case "AUTHENTICATE":
+		c.handleSASL(m)
+	case "PASS":
+		c.mu.Lock()
+		c.password = m.Param(0)
+		c.mu.Unlock()
+	case "NICK":
+		nick := m.Param(0)
+		if nick == "" {
+			c.numeric("431", "No nickname given")
+			break
+		}
+		if other := s.findClient(nick); other != nil && other != c {
+			c.numeric("433", nick, "Nickname is already in use")
+			break
+		}
+		old := c.prefix()
+		c.mu.Lock()
+		c.nick = nick
+		registered := c.registered
+		c.mu.Unlock()
+		if registered {
+			c.broadcast(":"+old, "NICK", nick)
+		}
+	case "USER":
+		c.mu.Lock()
+		c.user = m.Param(0)
+		c.realname = m.Param(3)
+		c.mu.Unlock()
+	case "PING":
+		c.Send(formatLine(":"+s.Name, "PONG", s.Name, m.Param(0)))
+	case "PONG":
+	case "JOIN":
+		for _, name := range strings.Split(m.Param(0), ",") {
+			c.join(name)
+		}
+	case "PART":
+		for _, name := range strings.Split(m.Param(0), ",") {
+			c.part(name, m.Param(1))
+		}
+	case "NAMES":
+		if len(m.Params) == 0 {
+			c.numeric("366", "*", "End of /NAMES list")
+			break
+		}
+		for _, name := range strings.Split(m.Param(0), ",") {
+			c.names(name)
+		}
+	case "TOPIC":
+		s.mu.Lock()
+		ch, ok := s.channels[strings.ToLower(m.Param(0))]
+		if ok && len(m.Params) > 1 {
+			ch.topic = m.Param(1)
+		}
+		s.mu.Unlock()
+		if ok && len(m.Params) > 1 {
+			c.toChannel(ch, true, ":"+c.prefix(), "TOPIC", ch.name, m.Param(1))
+		}
+	case "PRIVMSG", "NOTICE":
+		target := m.Param(0)
+		if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+			s.mu.Lock()
+			ch, ok := s.channels[strings.ToLower(target)]
+			s.mu.Unlock()
+			if ok {
+				c.toChannel(ch, false, ":"+c.prefix(), m.Command, ch.name, m.Param(1))
+			}
+		} else if other := s.findClient(target); other != nil {
+			other.Send(formatLine(":"+c.prefix(), m.Command, other.Nick(), m.Param(1)))
+		} else if m.Command == "PRIVMSG" {
+			c.numeric("401", target, "No such nick/channel")
+		}
+	case "QUIT":
+		c.broadcast(":"+c.prefix(), "QUIT", "Quit: "+m.Param(0))
+		c.Send("ERROR :Closing link")
+		return false
+	default:
+		c.numeric("421", m.Command, "Unknown command")
+	}
+	if m.Command == "NICK" || m.Command == "USER" || m.Command == "CAP" ||
+		m.Command == "AUTHENTICATE" {
+		return c.tryRegister()
+	}
+	return true
+}
+
+func (c *Client) handleCap(m *ircmsg.Message) {
+	s := c.srv
+	switch strings.ToUpper(m.Param(0)) {
+	case "LS":
+		c.mu.Lock()
+		c.negotiate = true
+		c.mu.Unlock()
+		v302 := m.Param(1) >= "302"
+		var caps []string
+		for name, value := range s.Caps {
+			if v302 && value != "" {
+				name += "=" + value
+			}
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		// Split long lists over several lines
+		var line []string
+		size := 0
+		for i, cap := range caps {
+			line = append(line, cap)
+			size += len(cap) + 1
+			if i == len(caps)-1 {
+				c.capReply("LS", "", strings.Join(line, " "))
+			} else if size > 300 && v302 {
+				c.capReply("LS", "*", strings.Join(line, " "))
+				line, size = nil, 0
+			}
+		}
+		if len(caps) == 0 {
+			c.capReply("LS", "", "")
+		}
+	case "LIST":
+		c.capReply("LIST", "", strings.Join(c.Caps(), " "))
+	case "REQ":
+		requested := strings.Fields(m.Trailing())
+		for _, name := range requested {
+			if _, ok := s.Caps[strings.TrimPrefix(name, "-")]; !ok {
+				c.capReply("NAK", "", m.Trailing())
+				return
+			}
+		}
+		c.mu.Lock()
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps, name[1:])
+			} else {
+				c.caps[name] = true
+			}
+		}
+		c.mu.Unlock()
+		c.capReply("ACK", "", m.Trailing())
+	case "END":
+		c.mu.Lock()
+		c.negotiate = false
+		c.mu.Unlock()
+	}
+}
+
+func (c *Client) capReply(sub, more, caps string) {
+	params := []string{sub}
+	if more != "" {
+		params = append(params, more)
+	}
+	params = append(params, caps)
+	c.numeric("CAP", params...)
+}
+
+func (c *Client) handleSASL(m *ircmsg.Message) {
+	s := c.srv
+	arg := m.Param(0)
+	c.mu.Lock()
+	mech := c.saslMech
+	c.mu.Unlock()
+	if arg == "*" {
+		c.setMech("")
+		c.numeric("906", "SASL authentication aborted")
+		return
+	}
+	if mech == "" {
+		switch arg {
+		case "PLAIN", "EXTERNAL", "SCRAM-SHA-1", "SCRAM-SHA-256":
+			c.setMech(arg)
+			if strings.HasPrefix(arg, "SCRAM-") {
+				c.mu.Lock()
+				c.scram = newScramServer(arg, s.Accounts)
+				c.mu.Unlock()
+			}
+			c.Send("AUTHENTICATE +")
+		default:
+			c.numeric("908", "PLAIN,EXTERNAL,SCRAM-SHA-1,SCRAM-SHA-256", "are available SASL mechanisms")
+			c.numeric("904", "SASL authentication failed")
+		}
+		return
+	}
+	// Payloads come in chunks of 400 bytes
+	c.mu.Lock()
+	if arg != "+" {
+		c.saslBuf += arg
+	}
+	payload := c.saslBuf
+	c.mu.Unlock()
+	if len(arg) == 400 {
+		return
+	}
+	c.mu.Lock()
+	c.saslBuf = ""
+	scram := c.scram
+	c.mu.Unlock()
+	data, err := base64.StdEncoding.DecodeString(payload)
+	var account string
+	switch {
+	case err != nil:
+	case mech == "PLAIN":
+		split := strings.Split(string(data), "\x00")
+		if len(split) == 3 {
+			if pass, ok := s.Accounts[split[1]]; ok && pass == split[2] {
+				account = split[1]
+			}
+		}
+	case mech == "EXTERNAL":
+		account = s.ExternalAccount
+	default:
+		var challenge []byte
+		challenge, account, err = scram.next(data)
+		if err == nil && account == "" {
+			c.authenticate(challenge)
+			return
+		}
+	}
+	c.setMech("")
+	if account == "" {
+		c.numeric("904", "SASL authentication failed")
+		return
+	}
+	c.mu.Lock()
+	c.account = account
+	c.mu.Unlock()
+	c.numeric("900", c.prefix(), account, "You are now logged in as "+account)
+	c.numeric("903", "SASL authentication successful")
+}
+
+// authenticate sends a SASL challenge in 400 byte chunks
+func (c *Client) authenticate(challenge []byte) {
+	payload := base64.StdEncoding.EncodeToString(challenge)
+	for len(payload) >= 400 {
+		c.Send("AUTHENTICATE " + payload[:400])
+		payload = payload[400:]
+	}
+	if payload == "" {
+		payload = "+"
+	}
+	c.Send("AUTHENTICATE " + payload)
+}
+
+func (c *Client) setMech(mech string) {
+	c.mu.Lock()
+	c.saslMech = mech
+	c.saslBuf = ""
+	c.mu.Unlock()
+}
+
+// tryRegister completes registration once NICK and USER are in
+// and capability negotiation is over, returns false to disconnect
+func (c *Client) tryRegister() bool {
+	s := c.srv
+	c.mu.Lock()
+	if c.registered || c.negotiate || c.nick == "" || c.user == "" {
+		c.mu.Unlock()
+		return true
+	}
+	badPass := s.Password != "" && c.password != s.Password
+	if !badPass {
+		c.registered = true
+	}
+	c.mu.Unlock()
+	if badPass {
+		c.numeric("464", "Password incorrect")
+		c.Send("ERROR :Closing link")
+		return false
+	}
+	c.numeric("001", "Welcome to the "+s.Network+" IRC Network "+c.prefix())
+	c.numeric("002", "Your host is "+s.Name)
+	c.numeric("003", "This server was created today")
+	c.numeric("004", s.Name, "kittytest", "iow", "beIklmnopstv")
+	isupport := append([]string{"NETWORK=" + s.Network}, s.ISupport...)
+	c.numeric("005", append(isupport, "are supported by this server")...)
+	c.numeric("422", "MOTD File is missing")
+	close(c.registerCh)
+	return true
+}
+
+func (c *Client) join(name string) {
+	s := c.srv
+	s.mu.Lock()
+	ch, ok := s.channels[strings.ToLower(name)]
+	if !ok {
+		ch = &channel{name: name, members: make(map[*Client]string)}
+		s.channels[strings.ToLower(name)] = ch
+	}
+	if _, ok := ch.members[c]; ok {
+		s.mu.Unlock()
+		return
+	}
+	// First one in gets ops
+	if len(ch.members) == 0 {
+		ch.members[c] = "@"
+	} else {
+		ch.members[c] = ""
+	}
+	topic := ch.topic
+	s.mu.Unlock()
+
+	c.toChannel(ch, true, ":"+c.prefix(), "JOIN", ch.name)
+	if topic != "" {
+		c.numeric("332", ch.name, topic)
+	}
+	c.names(ch.name)
+}
+
+// names sends the members of a channel, just the end for unknown channels
+func (c *Client) names(name string) {
+	s := c.srv
+	s.mu.Lock()
+	ch, ok := s.channels[strings.ToLower(name)]
+	var names []string
+	if ok {
+		name = ch.name
+		for member, prefix := range ch.members {
+			names = append(names, prefix+member.Nick())
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	if len(names) > 0 {
+		c.numeric("353", "=", name, strings.Join(names, " "))
+	}
+	c.numeric("366", name, "End of /NAMES list")
+}
+
+func (c *Client) part(name, reason string) {
+	s := c.srv
+	s.mu.Lock()
+	ch, ok := s.channels[strings.ToLower(name)]
+	if ok {
+		if _, ok = ch.members[c]; !ok {
+			s.mu.Unlock()
+			c.numeric("442", name, "You're not on that channel")
+			return
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.numeric("403", name, "No such channel")
+		return
+	}
+	params := []string{ch.name}
+	if reason != "" {
+		params = append(params, reason)
+	}
+	c.toChannel(ch, true, ":"+c.prefix(), "PART", params...)
+	s.mu.Lock()
+	delete(ch.members, c)
+	if len(ch.members) == 0 {
+		delete(s.channels, strings.ToLower(name))
+	}
+	s.mu.Unlock()
+}
+
+// toChannel sends a line to the members of a channel
+func (c *Client) toChannel(ch *channel, self bool, prefix, command string, params ...string) {
+	s := c.srv
+	s.mu.Lock()
+	var members []*Client
+	for member := range ch.members {
+		if member != c || self {
+			members = append(members, member)
+		}
+	}
+	s.mu.Unlock()
+	line := formatLine(prefix, command, params...)
+	for _, member := range members {
+		member.Send(line)
+	}
+}
+
+// broadcast sends a line to everyone sharing a channel with the client, and the client
+func (c *Client) broadcast(prefix, command string, params ...string) {
+	s := c.srv
+	seen := map[*Client]bool{c: true}
+	s.mu.Lock()
+	for _, ch := range s.channels {
+		if _, ok := ch.members[c]; !ok {
+			continue
+		}
+		for member := range ch.members {
+			seen[member] = true
+		}
+	}
+	s.mu.Unlock()
+	line := formatLine(prefix, command, params...)
+	for member := range seen {
+		member.Send(line)
+	}
+}
+
+// formatLine builds a line, the last parameter is always sent as trailing
+func formatLine(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(prefix)
+		b.WriteByte(' ')
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		b.WriteByte(' ')
+		if i == len(params)-1 {
+			b.WriteByte(':')
+		}
+		b.WriteString(param)
+	}
+	return b.String()
+}
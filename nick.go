@@ -0,0 +1,144 @@
+package kitty
+
+import (
+	"strings"
+)
+
+// How many underscores we append to Nick before giving up
+const maxNickSuffix = 5
+
+// CurrentNick returns the nick the bot is using right now,
+// it differs from Nick when the configured nick was taken
+func (bot *Bot) CurrentNick() string {
+	return bot.getNick()
+}
+
+// nextNick returns the next nick to try during registration:
+// AltNicks in order, then Nick with a growing "_" suffix.
+// Empty when we are out of options
+func (bot *Bot) nextNick() string {
+	bot.mu.Lock()
+	bot.nickAttempt++
+	n := bot.nickAttempt
+	bot.mu.Unlock()
+	if n <= len(bot.AltNicks) {
+		return bot.AltNicks[n-1]
+	}
+	n -= len(bot.AltNicks)
+	if n > maxNickSuffix {
+		return ""
+	}
+	suffix := strings.Repeat("_", n)
+	nick := bot.Nick
+	max := bot.isupport.NickLen()
+	if len(nick)+len(suffix) > max {
+		if len(suffix) >= max {
+			return ""
+		}
+		nick = nick[:max-len(suffix)]
+	}
+	return nick + suffix
+}
+
+// Try the next nick when ours is taken or invalid during registration
+var nickFallback = Trigger{
+	Condition: func(bot *Bot, m *Message) bool {
+		return (m.Command == "433" || m.Command == "436" || m.Command == "432") &&
+			!bot.isRegistered()
+	},
+	Action: func(bot *Bot, m *Message) {
+		nick := bot.nextNick()
+		if nick == "" {
+			err := ErrNickInUse
+			if m.Command == "432" {
+				err = ErrBadNick
+			}
+			bot.close("register", &RegistrationError{
+				Numeric: m.Command,
+				Message: m.Content,
+				Err:     err,
+			})
+			return
+		}
+		bot.Info("nick unavailable, trying another", "nick", m.Param(1), "next", nick)
+		bot.mu.Lock()
+		bot.nick = nick
+		bot.mu.Unlock()
+		bot.PrefixChange(nick, "", "")
+		bot.SetNick(nick)
+	},
+}
+
+// Get the configured nick back once it is free
+var regainNick = Trigger{
+	Condition: func(bot *Bot, m *Message) bool {
+		switch m.Command {
+		case "376", "422", "QUIT", "NICK", "731":
+			return bot.RegainNick && bot.isRegistered()
+		}
+		return false
+	},
+	Action: func(bot *Bot, m *Message) {
+		if bot.EqualFold(bot.getNick(), bot.Nick) {
+			// setNick has already seen our own NICK
+			if m.Command == "NICK" && bot.EqualFold(m.To, bot.Nick) {
+				bot.stopMonitor()
+			}
+			return
+		}
+		switch m.Command {
+		case "376", "422":
+			bot.startRegain()
+		case "QUIT":
+			if bot.EqualFold(m.Name, bot.Nick) {
+				bot.SetNick(bot.Nick)
+			}
+		case "NICK":
+			if bot.EqualFold(m.Name, bot.Nick) {
+				bot.SetNick(bot.Nick)
+			}
+		case "731":
+			// RPL_MONOFFLINE targets can be nick!user@host
+			for _, target := range strings.Split(m.Trailing(), ",") {
+				if bot.EqualFold(strings.SplitN(target, "!", 2)[0], bot.Nick) {
+					bot.SetNick(bot.Nick)
+				}
+			}
+		}
+	},
+}
+
+// startRegain asks NickServ to free Nick, if configured,
+// and monitors it when the server supports MONITOR.
+// Without MONITOR we rely on seeing the holder quit or change nick
+func (bot *Bot) startRegain() {
+	bot.Info("trying to regain nick", "nick", bot.Nick)
+	if bot.NickServRegain != "" {
+		command := strings.ToUpper(bot.NickServRegain)
+		line := "PRIVMSG NickServ :" + command + " " + bot.Nick
+		if bot.NickServPassword != "" {
+			line += " " + bot.NickServPassword
+		}
+		bot.Send(line)
+		// REGAIN changes our nick, GHOST only frees it
+		if command == "GHOST" {
+			bot.SetNick(bot.Nick)
+		}
+	}
+	if _, ok := bot.isupport.Get("MONITOR"); ok {
+		bot.mu.Lock()
+		bot.monitoring = true
+		bot.mu.Unlock()
+		bot.Send("MONITOR + " + bot.Nick)
+	}
+}
+
+func (bot *Bot) stopMonitor() {
+	bot.mu.Lock()
+	monitoring := bot.monitoring
+	bot.monitoring = false
+	bot.mu.Unlock()
+	if monitoring {
+		bot.Send("MONITOR - " + bot.Nick)
+	}
+}
@@ -0,0 +1,117 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// takenNicks answers NICK with 433 for the nicks marked taken
+type takenNicks struct {
+	mu    sync.Mutex
+	taken map[string]bool
+}
+
+func (n *takenNicks) set(nick string, taken bool) {
+	n.mu.Lock()
+	n.taken[nick] = taken
+	n.mu.Unlock()
+}
+
+func (n *takenNicks) handle(c *kittytest.Client, m *ircmsg.Message) bool {
+	n.mu.Lock()
+	taken := m.Command == "NICK" && (n.taken[m.Param(0)] || n.taken["*"])
+	n.mu.Unlock()
+	if taken {
+		nick := c.Nick()
+		if nick == "" {
+			nick = "*"
+		}
+		c.Send(":irc.test 433 " + nick + " " + m.Param(0) + " :Nickname is already in use")
+	}
+	return taken
+}
+
+func nickServer(t *testing.T, taken ...string) (*kittytest.Server, *takenNicks) {
+	n := &takenNicks{taken: make(map[string]bool)}
+	for _, nick := range taken {
+		n.taken[nick] = true
+	}
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.ISupport = append(srv.ISupport, "MONITOR=100")
+		srv.Handler = n.handle
+	})
+	return srv, n
+}
+
+func TestAltNicks(t *testing.T) {
+	srv, _ := nickServer(t, "kittybot", "kitty2")
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.AltNicks = []string{"kitty2", "kitty3"}
+		bot.RegainNick = false
+	})
+	if bot.CurrentNick() != "kitty3" || c.Nick() != "kitty3" {
+		t.Fatalf("registered as %q, server says %q", bot.CurrentNick(), c.Nick())
+	}
+}
+
+func TestNickSuffix(t *testing.T) {
+	srv, _ := nickServer(t, "kittybot", "kittybot_")
+	bot, _ := startBot(t, srv, func(bot *Bot) {
+		bot.RegainNick = false
+	})
+	// NICKLEN is 9 until the server sends 005
+	if bot.CurrentNick() != "kittybo__" {
+		t.Fatalf("registered as %q", bot.CurrentNick())
+	}
+}
+
+func TestNickInUse(t *testing.T) {
+	srv, _ := nickServer(t, "*")
+	bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+		bot.ThrottleDelay = 0
+		bot.AltNicks = []string{"kitty2"}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := bot.RunContext(ctx)
+	var regErr *RegistrationError
+	if !errors.Is(err, ErrNickInUse) || !errors.As(err, &regErr) || regErr.Numeric != "433" {
+		t.Fatalf("got %v, want ErrNickInUse from a 433", err)
+	}
+}
+
+func TestRegainNick(t *testing.T) {
+	for _, how := range []string{"quit", "nick", "monitor"} {
+		srv, taken := nickServer(t, "kittybot")
+		bot, c := startBot(t, srv)
+		if bot.CurrentNick() != "kittybot_" {
+			t.Fatalf("%s: registered as %q", how, bot.CurrentNick())
+		}
+		// Without NickServRegain the bot only watches the nick
+		if _, err := c.Expect(time.Second, `^MONITOR \+ kittybot$`); err != nil {
+			t.Fatalf("%s: %v", how, err)
+		}
+		taken.set("kittybot", false)
+		switch how {
+		case "quit":
+			c.Send(":kittybot!u@h QUIT :bye")
+		case "nick":
+			c.Send(":kittybot!u@h NICK somecat")
+		case "monitor":
+			c.Send(":irc.test 731 kittybot_ :kittybot!u@h")
+		}
+		if _, err := c.Expect(time.Second, `^NICK kittybot$`); err != nil {
+			t.Fatalf("%s: %v", how, err)
+		}
+		waitFor(t, "the nick back", func() bool { return bot.CurrentNick() == "kittybot" })
+		if _, err := c.Expect(time.Second, `^MONITOR - kittybot$`); err != nil {
+			t.Fatalf("%s: %v", how, err)
+		}
+	}
+}
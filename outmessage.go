@@ -0,0 +1,207 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidMessage is returned for messages that can't be sent as is,
+// like text with embedded CR, LF or NUL that could smuggle in extra commands
+var ErrInvalidMessage = errors.New("kitty: invalid message")
+
+// OutMessage is a message to send to the server
+type OutMessage struct {
+	// IRCv3 tags, like "+draft/reply", an empty value sends the key only.
+	// Tags are left out if the server hasn't enabled message-tags
+	Tags    map[string]string
+	Command string
+	// The last parameter is sent as trailing when it needs to be
+	Params []string
+}
+
+// Encode validates the message and returns it as a line without CR LF
+func (om OutMessage) Encode() (string, error) {
+	var b strings.Builder
+	if len(om.Tags) > 0 {
+		keys := make([]string, 0, len(om.Tags))
+		for key := range om.Tags {
+			if key == "" || strings.ContainsAny(key, " ;=\r\n\x00") {
+				return "", fmt.Errorf("%w: bad tag key %q", ErrInvalidMessage, key)
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(key)
+			if value := om.Tags[key]; value != "" {
+				b.WriteByte('=')
+				b.WriteString(tagEscaper.Replace(value))
+			}
+		}
+		b.WriteByte(' ')
+	}
+	if !validCommand(om.Command) {
+		return "", fmt.Errorf("%w: bad command %q", ErrInvalidMessage, om.Command)
+	}
+	b.WriteString(om.Command)
+	for i, param := range om.Params {
+		if strings.ContainsAny(param, "\r\n\x00") {
+			return "", fmt.Errorf("%w: CR, LF or NUL in parameter", ErrInvalidMessage)
+		}
+		b.WriteByte(' ')
+		if i == len(om.Params)-1 {
+			if param == "" || param[0] == ':' || strings.IndexByte(param, ' ') >= 0 {
+				b.WriteByte(':')
+			}
+			b.WriteString(param)
+			break
+		}
+		if param == "" || param[0] == ':' || strings.IndexByte(param, ' ') >= 0 {
+			return "", fmt.Errorf("%w: only the last parameter can be empty, start with : or contain spaces", ErrInvalidMessage)
+		}
+		b.WriteString(param)
+	}
+	return b.String(), nil
+}
+
+var tagEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+// Commands are letters or a three digit numeric
+func validCommand(command string) bool {
+	if command == "" {
+		return false
+	}
+	for _, c := range command {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateLine checks a raw line for characters that would split it
+func validateLine(line string) error {
+	if strings.ContainsAny(line, "\r\n\x00") {
+		return fmt.Errorf("%w: CR, LF or NUL in line", ErrInvalidMessage)
+	}
+	return nil
+}
+
+// stripLine turns characters that would split a line into spaces
+func stripLine(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// encode strips the tags if the server doesn't take them
+// and checks that the line fits
+func (bot *Bot) encode(om OutMessage) (string, error) {
+	if len(om.Tags) > 0 {
+		if enabled, _ := bot.CapStatus(CapMessageTags); !enabled {
+			om.Tags = nil
+		}
+	}
+	line, err := om.Encode()
+	if err != nil {
+		return "", err
+	}
+	body := line
+	if line[0] == '@' {
+		body = line[strings.IndexByte(line, ' ')+1:]
+	}
+	if len(body) > bot.isupport.LineLen()-2 {
+		return "", fmt.Errorf("%w: line too long", ErrInvalidMessage)
+	}
+	return line, nil
+}
+
+// SendMessage queues the message, it returns ErrInvalidMessage
+// for messages that don't encode and otherwise behaves like SendContext
+func (bot *Bot) SendMessage(ctx context.Context, om OutMessage) error {
+	line, err := bot.encode(om)
+	if err != nil {
+		return err
+	}
+	return bot.SendContext(ctx, line)
+}
+
+// SendMessageAsync queues the message and returns a Delivery
+// that resolves once the message has been written to the connection.
+// Like Send it blocks while the queue is full
+func (bot *Bot) SendMessageAsync(om OutMessage) *Delivery {
+	d := &Delivery{done: make(chan struct{})}
+	line, err := bot.encode(om)
+	if err != nil {
+		d.resolve(err)
+		return d
+	}
+	done, err := bot.sendable()
+	if err != nil {
+		d.resolve(err)
+		return d
+	}
+	if err := bot.enqueue(context.Background(), done, queuedLine{line: line, delivery: d}); err != nil {
+		d.resolve(err)
+	}
+	return d
+}
+
+// Delivery is the outcome of SendMessageAsync
+type Delivery struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the message has been written or has failed
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns nil if the message was written, only valid after Done is closed
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the delivery or for ctx to be done
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(err error) {
+	if d == nil {
+		return
+	}
+	d.once.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
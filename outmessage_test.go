@@ -0,0 +1,176 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuitReason(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	bot.Quit("bye\r\nPRIVMSG #test :injected\x00")
+	if _, err := c.Expect(time.Second, `^QUIT :bye  PRIVMSG #test :injected $`); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, "PRIVMSG") {
+			t.Fatalf("smuggled %q", line)
+		}
+	}
+}
+
+func TestWriterValidates(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	// Lines that got into the queue some other way
+	d := &Delivery{done: make(chan struct{})}
+	bot.outgoing <- queuedLine{line: "PRIVMSG #test :hi\r\nJOIN #evil", delivery: d}
+	bot.Send("PRIVMSG #test :next")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Wait(ctx); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("got %v, want ErrInvalidMessage", err)
+	}
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test :next$`); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range c.Lines() {
+		if strings.Contains(line, "#evil") || line == "PRIVMSG #test :hi" {
+			t.Fatalf("sent %q", line)
+		}
+	}
+}
+
+func TestSendAfterClose(t *testing.T) {
+	srv := newServer(t)
+	bot, _ := startBot(t, srv)
+	bot.Close()
+	for i := 0; i < 50; i++ {
+		d := bot.SendMessageAsync(OutMessage{Command: "PRIVMSG", Params: []string{"#test", "hi"}})
+		select {
+		case <-d.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d never resolved", i)
+		}
+		if err := d.Err(); err != ErrClosed {
+			t.Fatalf("delivery %d: got %v, want ErrClosed", i, err)
+		}
+		if err := bot.SendContext(context.Background(), "PRIVMSG #test :hi"); err != ErrClosed {
+			t.Fatalf("SendContext: got %v, want ErrClosed", err)
+		}
+	}
+	if priority, normal := bot.QueueLen(); priority+normal != 0 {
+		t.Fatalf("%d lines left in the queues", priority+normal)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		msg  OutMessage
+		want string
+	}{
+		{OutMessage{Command: "PING", Params: []string{"x"}}, "PING x"},
+		{OutMessage{Command: "PRIVMSG", Params: []string{"#test", "hello there"}}, "PRIVMSG #test :hello there"},
+		{OutMessage{Command: "PRIVMSG", Params: []string{"#test", ":)"}}, "PRIVMSG #test ::)"},
+		{OutMessage{Command: "TOPIC", Params: []string{"#test", ""}}, "TOPIC #test :"},
+		{OutMessage{Command: "AWAY"}, "AWAY"},
+		{OutMessage{Command: "001"}, "001"},
+		{
+			OutMessage{Tags: map[string]string{"+draft/reply": "abc", "+typing": ""}, Command: "TAGMSG", Params: []string{"#test"}},
+			"@+draft/reply=abc;+typing TAGMSG #test",
+		},
+		{
+			OutMessage{Tags: map[string]string{"+x": "a;b c\\d\r\n"}, Command: "TAGMSG", Params: []string{"#test"}},
+			`@+x=a\:b\sc\\d\r\n TAGMSG #test`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.msg.Encode()
+		if err != nil || got != tt.want {
+			t.Errorf("%+v: got %q, %v, want %q", tt.msg, got, err, tt.want)
+		}
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	tests := map[string]OutMessage{
+		"CR in trailing":     {Command: "PRIVMSG", Params: []string{"#test", "hi\rQUIT"}},
+		"LF in trailing":     {Command: "PRIVMSG", Params: []string{"#test", "hi\nQUIT"}},
+		"NUL in trailing":    {Command: "PRIVMSG", Params: []string{"#test", "hi\x00"}},
+		"LF in middle":       {Command: "PRIVMSG", Params: []string{"#te\nst", "hi"}},
+		"empty middle":       {Command: "PRIVMSG", Params: []string{"", "hi"}},
+		"space in middle":    {Command: "PRIVMSG", Params: []string{"#a #b", "hi"}},
+		"colon middle":       {Command: "PRIVMSG", Params: []string{":#test", "hi"}},
+		"empty command":      {Params: []string{"x"}},
+		"space in command":   {Command: "PRIVMSG #test"},
+		"newline in command": {Command: "PING\r\nQUIT"},
+		"empty tag key":      {Tags: map[string]string{"": "x"}, Command: "TAGMSG"},
+		"space in tag key":   {Tags: map[string]string{"a b": "x"}, Command: "TAGMSG"},
+		"; in tag key":       {Tags: map[string]string{"a;b": "x"}, Command: "TAGMSG"},
+		"= in tag key":       {Tags: map[string]string{"a=b": "x"}, Command: "TAGMSG"},
+		"LF in tag key":      {Tags: map[string]string{"a\nb": "x"}, Command: "TAGMSG"},
+	}
+	for name, msg := range tests {
+		if line, err := msg.Encode(); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: got %q, %v, want ErrInvalidMessage", name, line, err)
+		}
+	}
+}
+
+func TestValidateLine(t *testing.T) {
+	for _, line := range []string{"PRIVMSG #test :hi", "@a=b PING x", "PRIVMSG #test :tab\there"} {
+		if err := validateLine(line); err != nil {
+			t.Errorf("%q: %v", line, err)
+		}
+	}
+	for _, line := range []string{"PRIVMSG #test :hi\r\nQUIT", "PING x\n", "PING\rx", "PING \x00"} {
+		if err := validateLine(line); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%q: got %v, want ErrInvalidMessage", line, err)
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tagged := OutMessage{Tags: map[string]string{"+x": "y"}, Command: "PRIVMSG", Params: []string{"#test", "one two"}}
+	if err := bot.SendMessage(ctx, tagged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expect(time.Second, `^@\+x=y PRIVMSG #test :one two$`); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.SendMessage(ctx, OutMessage{Command: "PRIVMSG", Params: []string{"#test", strings.Repeat("a", 600)}}); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("long line: got %v, want ErrInvalidMessage", err)
+	}
+	if err := bot.SendContext(ctx, "PRIVMSG #test :a\r\nQUIT"); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("SendContext: got %v, want ErrInvalidMessage", err)
+	}
+	d := bot.SendMessageAsync(OutMessage{Command: "PRIVMSG", Params: []string{"#test", "async"}})
+	if err := d.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test async$`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendMessageNoTags(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.DisableCaps = []string{CapMessageTags}
+	})
+	// Without message-tags the tags are left out
+	tagged := OutMessage{Tags: map[string]string{"+x": "y"}, Command: "PRIVMSG", Params: []string{"#test", "one two"}}
+	if err := bot.SendMessage(context.Background(), tagged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test :one two$`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,316 @@
+package kitty
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WhoisInfo is the reply to WHOIS
+type WhoisInfo struct {
+	Nick     string
+	User     string
+	Host     string
+	Realname string
+	// Server the user is on and its description
+	Server     string
+	ServerInfo string
+	// Is an IRC operator (313)
+	Operator bool
+	// Idle time and sign on time, zero if the server didn't say (317)
+	Idle   time.Duration
+	SignOn time.Time
+	// Channels with their prefixes, like "@#kittybot" (319)
+	Channels []string
+	// Account name, empty if not logged in (330)
+	Account string
+	// Connected with TLS (671)
+	Secure bool
+	// Away message, empty if not away (301)
+	Away string
+}
+
+// Whois looks up a nick, it returns ErrNoSuchNick if the nick isn't online
+func (bot *Bot) Whois(ctx context.Context, nick string) (*WhoisInfo, error) {
+	replies, err := bot.Request(ctx, "WHOIS "+nick)
+	if err != nil {
+		return nil, err
+	}
+	info := &WhoisInfo{Nick: nick}
+	var found bool
+	for _, m := range replies {
+		if !bot.EqualFold(m.Param(1), nick) {
+			continue
+		}
+		switch m.Command {
+		case "311":
+			found = true
+			info.Nick = m.Param(1)
+			info.User = m.Param(2)
+			info.Host = m.Param(3)
+			info.Realname = m.Param(5)
+		case "312":
+			info.Server = m.Param(2)
+			info.ServerInfo = m.Param(3)
+		case "313":
+			info.Operator = true
+		case "317":
+			if idle, err := strconv.ParseInt(m.Param(2), 10, 64); err == nil {
+				info.Idle = time.Duration(idle) * time.Second
+			}
+			if ts, err := strconv.ParseInt(m.Param(3), 10, 64); err == nil {
+				info.SignOn = time.Unix(ts, 0)
+			}
+		case "319":
+			info.Channels = append(info.Channels, strings.Fields(m.Param(2))...)
+		case "330":
+			info.Account = m.Param(2)
+		case "671":
+			info.Secure = true
+		case "301":
+			info.Away = m.Param(2)
+		}
+	}
+	if err := queryError(replies); err != nil && !found {
+		return nil, err
+	}
+	if !found {
+		return nil, &QueryError{Numeric: "401", Message: "No such nick"}
+	}
+	return info, nil
+}
+
+// WhoReply is a line of the reply to WHO
+type WhoReply struct {
+	// Channel the reply is about, "*" if none
+	Channel  string
+	Nick     string
+	User     string
+	Host     string
+	Server   string
+	Realname string
+	Hops     int
+	Away     bool
+	Operator bool
+	// Channel prefixes, like "@"
+	Prefixes string
+	// WHOX only, empty if not logged in
+	Account string
+	// WHOX only, the IP address if the server shows it
+	IP string
+	// WHOX only
+	Idle time.Duration
+}
+
+// Token that marks our WHOX replies
+const whoxToken = "616"
+
+// WHOX fields in the order the server sends them
+const whoxOrder = "tcuihsnfdlaor"
+
+// Every WHOX field WhoReply has room for
+const whoxAll = "tcuihsnfdlar"
+
+// Who lists the users matching the mask, with every field WHOX offers
+func (bot *Bot) Who(ctx context.Context, mask string) ([]WhoReply, error) {
+	return bot.WhoFields(ctx, mask, "")
+}
+
+// WhoFields is like Who but asks a WHOX server only for the given fields,
+// like "cnfa" for channel, nick, flags and account. Empty asks for all of them.
+// Without WHOX it sends a plain WHO and the fields are ignored
+func (bot *Bot) WhoFields(ctx context.Context, mask, fields string) ([]WhoReply, error) {
+	_, whox := bot.isupport.Get("WHOX")
+	command := "WHO " + mask
+	if whox {
+		if fields == "" {
+			fields = whoxAll
+		}
+		if strings.IndexByte(fields, 't') < 0 {
+			fields = "t" + fields
+		}
+		command += " %" + fields + "," + whoxToken
+	}
+	replies, err := bot.Request(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	_, symbols := bot.isupport.Prefix()
+	var list []WhoReply
+	for _, m := range replies {
+		switch m.Command {
+		case "352":
+			r := WhoReply{
+				Channel: m.Param(1),
+				User:    m.Param(2),
+				Host:    m.Param(3),
+				Server:  m.Param(4),
+				Nick:    m.Param(5),
+			}
+			r.parseFlags(m.Param(6), symbols)
+			hops := strings.SplitN(m.Param(7), " ", 2)
+			r.Hops, _ = strconv.Atoi(hops[0])
+			if len(hops) == 2 {
+				r.Realname = hops[1]
+			}
+			list = append(list, r)
+		case "354":
+			if r, ok := parseWhox(m.Params[1:], fields, symbols); ok {
+				list = append(list, r)
+			}
+		}
+	}
+	if err := queryError(replies); err != nil && len(list) == 0 {
+		return nil, err
+	}
+	return list, nil
+}
+
+// parseWhox reads the fields of a 354 reply, they come in whoxOrder
+func parseWhox(params []string, fields, symbols string) (r WhoReply, ok bool) {
+	for _, field := range whoxOrder {
+		if strings.IndexRune(fields, field) < 0 {
+			continue
+		}
+		if len(params) == 0 {
+			return r, false
+		}
+		value := params[0]
+		params = params[1:]
+		switch field {
+		case 't':
+			if value != whoxToken {
+				return r, false
+			}
+		case 'c':
+			r.Channel = value
+		case 'u':
+			r.User = value
+		case 'i':
+			if value != "255.255.255.255" {
+				r.IP = value
+			}
+		case 'h':
+			r.Host = value
+		case 's':
+			r.Server = value
+		case 'n':
+			r.Nick = value
+		case 'f':
+			r.parseFlags(value, symbols)
+		case 'd':
+			r.Hops, _ = strconv.Atoi(value)
+		case 'l':
+			if idle, err := strconv.Atoi(value); err == nil {
+				r.Idle = time.Duration(idle) * time.Second
+			}
+		case 'a':
+			if value != "0" {
+				r.Account = value
+			}
+		case 'r':
+			r.Realname = value
+		}
+	}
+	return r, true
+}
+
+// Flags look like "H*@", here or gone, oper, then channel prefixes
+func (r *WhoReply) parseFlags(flags, symbols string) {
+	r.Away = strings.HasPrefix(flags, "G")
+	var prefixes []byte
+	for i := 0; i < len(flags); i++ {
+		switch {
+		case flags[i] == '*':
+			r.Operator = true
+		case strings.IndexByte(symbols, flags[i]) >= 0:
+			prefixes = append(prefixes, flags[i])
+		}
+	}
+	r.Prefixes = string(prefixes)
+}
+
+// NamesReply is a member of a channel in the reply to NAMES
+type NamesReply struct {
+	Nick string
+	// Channel prefixes, like "@"
+	Prefixes string
+	// Only with userhost-in-names
+	User string
+	Host string
+}
+
+// Names lists the members of a channel
+func (bot *Bot) Names(ctx context.Context, channel string) ([]NamesReply, error) {
+	replies, err := bot.Request(ctx, "NAMES "+channel)
+	if err != nil {
+		return nil, err
+	}
+	_, symbols := bot.isupport.Prefix()
+	var list []NamesReply
+	for _, m := range replies {
+		if m.Command != "353" || !bot.EqualFold(m.Param(2), channel) {
+			continue
+		}
+		for _, entry := range strings.Fields(m.Param(3)) {
+			name := strings.TrimLeft(entry, symbols)
+			r := NamesReply{Nick: name, Prefixes: entry[:len(entry)-len(name)]}
+			if i := strings.IndexByte(name, '!'); i >= 0 {
+				r.Nick = name[:i]
+				r.User = name[i+1:]
+				if j := strings.IndexByte(r.User, '@'); j >= 0 {
+					r.Host = r.User[j+1:]
+					r.User = r.User[:j]
+				}
+			}
+			list = append(list, r)
+		}
+	}
+	if err := queryError(replies); err != nil && len(list) == 0 {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ListReply is a channel in the reply to LIST
+type ListReply struct {
+	Channel string
+	Users   int
+	Topic   string
+}
+
+// List lists channels, filter is passed on to LIST as is,
+// like "#kitty*" or ">100" on servers that support it. Empty lists all
+func (bot *Bot) List(ctx context.Context, filter string) ([]ListReply, error) {
+	command := "LIST"
+	if filter != "" {
+		command += " " + filter
+	}
+	replies, err := bot.Request(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	var list []ListReply
+	for _, m := range replies {
+		if m.Command != "322" {
+			continue
+		}
+		users, _ := strconv.Atoi(m.Param(2))
+		list = append(list, ListReply{Channel: m.Param(1), Users: users, Topic: m.Param(3)})
+	}
+	if err := queryError(replies); err != nil && len(list) == 0 {
+		return nil, err
+	}
+	return list, nil
+}
+
+// queryError returns the first error numeric in the replies
+func queryError(replies []*Message) error {
+	for _, m := range replies {
+		if isNumeric(m.Command) && m.Command[0] >= '4' && m.Command[0] <= '5' {
+			return &QueryError{Numeric: m.Command, Message: m.Trailing()}
+		}
+	}
+	return nil
+}
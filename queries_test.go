@@ -0,0 +1,176 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// queryServer answers WHOIS, WHO and LIST about a few cats
+func queryServer(t *testing.T, whox bool) *kittytest.Server {
+	return newServer(t, func(srv *kittytest.Server) {
+		if whox {
+			srv.ISupport = append(srv.ISupport, "WHOX")
+		}
+		srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+			var lines []string
+			switch m.Command {
+			case "WHOIS":
+				if m.Param(0) != "kitty" {
+					lines = []string{
+						"401 kittybot " + m.Param(0) + " :No such nick/channel",
+						"318 kittybot " + m.Param(0) + " :End of /WHOIS list",
+					}
+					break
+				}
+				lines = []string{
+					"311 kittybot Kitty u cat.host * :Kitty Cat",
+					"312 kittybot Kitty irc.test :Test server",
+					"313 kittybot Kitty :is an IRC operator",
+					"317 kittybot Kitty 60 1700000000 :seconds idle, signon time",
+					"319 kittybot Kitty :@#cats +#dogs",
+					"319 kittybot Kitty :#birds",
+					"330 kittybot Kitty kittyacct :is logged in as",
+					"671 kittybot Kitty :is using a secure connection",
+					"301 kittybot Kitty :napping",
+					"318 kittybot kitty :End of /WHOIS list",
+				}
+			case "WHO":
+				if !whox {
+					lines = []string{
+						"352 kittybot #cats u cat.host irc.test Kitty H*@ :0 Kitty Cat",
+						"352 kittybot #cats d dog.host irc.test dog G :2 Dog",
+					}
+				} else if m.Param(1) == "%tcnfa,616" {
+					lines = []string{
+						"354 kittybot 616 #cats Kitty H*@ kittyacct",
+						"354 kittybot 616 #cats dog G 0",
+						// Someone else's WHOX
+						"354 kittybot 999 #cats mouse H 0",
+					}
+				} else {
+					t.Errorf("WHO %q", m.Params)
+				}
+				lines = append(lines, "315 kittybot "+m.Param(0)+" :End of /WHO list")
+			case "LIST":
+				lines = []string{
+					"321 kittybot Channel :Users  Name",
+					"322 kittybot #cats 5 :[+nt] Cats only",
+					"322 kittybot #dogs 2 :",
+					"323 kittybot :End of /LIST",
+				}
+			default:
+				return false
+			}
+			for _, line := range lines {
+				c.Send(":irc.test " + line)
+			}
+			return true
+		}
+	})
+}
+
+func TestWhois(t *testing.T) {
+	bot, _ := startBot(t, queryServer(t, false))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	info, err := bot.Whois(ctx, "kitty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WhoisInfo{
+		Nick: "Kitty", User: "u", Host: "cat.host", Realname: "Kitty Cat",
+		Server: "irc.test", ServerInfo: "Test server", Operator: true,
+		Idle: time.Minute, SignOn: time.Unix(1700000000, 0),
+		Channels: []string{"@#cats", "+#dogs", "#birds"},
+		Account:  "kittyacct", Secure: true, Away: "napping",
+	}
+	if !reflect.DeepEqual(*info, want) {
+		t.Fatalf("got %+v\nwant %+v", *info, want)
+	}
+
+	_, err = bot.Whois(ctx, "nobody")
+	var queryErr *QueryError
+	if !errors.Is(err, ErrNoSuchNick) || !errors.As(err, &queryErr) || queryErr.Numeric != "401" {
+		t.Fatalf("got %v, want ErrNoSuchNick", err)
+	}
+}
+
+func TestWho(t *testing.T) {
+	bot, _ := startBot(t, queryServer(t, false))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	list, err := bot.Who(ctx, "#cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WhoReply{
+		{Channel: "#cats", Nick: "Kitty", User: "u", Host: "cat.host", Server: "irc.test",
+			Realname: "Kitty Cat", Operator: true, Prefixes: "@"},
+		{Channel: "#cats", Nick: "dog", User: "d", Host: "dog.host", Server: "irc.test",
+			Realname: "Dog", Hops: 2, Away: true},
+	}
+	if len(list) != len(want) || list[0] != want[0] || list[1] != want[1] {
+		t.Fatalf("got %+v", list)
+	}
+}
+
+func TestWhox(t *testing.T) {
+	bot, _ := startBot(t, queryServer(t, true))
+	// WHOX is known from 005
+	waitFor(t, "WHOX", func() bool {
+		_, ok := bot.ISupport().Get("WHOX")
+		return ok
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	list, err := bot.WhoFields(ctx, "#cats", "cnfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WhoReply{
+		{Channel: "#cats", Nick: "Kitty", Operator: true, Prefixes: "@", Account: "kittyacct"},
+		{Channel: "#cats", Nick: "dog", Away: true},
+	}
+	if len(list) != len(want) || list[0] != want[0] || list[1] != want[1] {
+		t.Fatalf("got %+v", list)
+	}
+}
+
+func TestParseWhox(t *testing.T) {
+	params := []string{"616", "#cats", "u", "10.0.0.1", "cat.host", "irc.test", "Kitty", "H@", "1", "30", "kittyacct", "Kitty Cat"}
+	r, ok := parseWhox(params, whoxAll, "@+")
+	want := WhoReply{
+		Channel: "#cats", User: "u", IP: "10.0.0.1", Host: "cat.host", Server: "irc.test",
+		Nick: "Kitty", Prefixes: "@", Hops: 1, Idle: 30 * time.Second, Account: "kittyacct", Realname: "Kitty Cat",
+	}
+	if !ok || r != want {
+		t.Fatalf("got %+v, %v", r, ok)
+	}
+	// Hidden IPs and missing fields
+	if r, ok := parseWhox([]string{"616", "255.255.255.255"}, "ti", "@+"); !ok || r.IP != "" {
+		t.Fatalf("got %+v, %v", r, ok)
+	}
+	if _, ok := parseWhox([]string{"616", "#cats"}, "tcn", "@+"); ok {
+		t.Fatal("short reply accepted")
+	}
+}
+
+func TestList(t *testing.T) {
+	bot, _ := startBot(t, queryServer(t, false))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	list, err := bot.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ListReply{{"#cats", 5, "[+nt] Cats only"}, {"#dogs", 2, ""}}
+	if len(list) != len(want) || list[0] != want[0] || list[1] != want[1] {
+		t.Fatalf("got %+v", list)
+	}
+}
@@ -1,6 +1,7 @@
 package kitty
 
 import (
+	"sync"
 	"time"
 )
 
@@ -57,3 +58,160 @@ func (rl *rateLimiter) drop() bool {
 		return true
 	}
 }
+
+// LimitAction is what a Limiter does with a message over its limit
+type LimitAction int
+
+const (
+	// LimitDrop refuses the message silently (default)
+	LimitDrop LimitAction = iota
+	// LimitQueue waits until the limit allows the message
+	LimitQueue
+	// LimitNotify refuses the message and, once until the limit
+	// allows messages again, sends the sender a notice
+	LimitNotify
+)
+
+// Limit configures a token bucket
+type Limit struct {
+	// Messages allowed per Interval, 0 means no limit
+	Messages int
+	Interval time.Duration
+	Action   LimitAction
+	// Notice sent with LimitNotify (default "slow down")
+	Notice string
+}
+
+// Limiter rate limits incoming messages by sender and by target,
+// every sender and every target gets its own token bucket.
+// Use it from triggers or set it as Router.Limiter.
+// It is safe for concurrent use
+type Limiter struct {
+	// Limit per sender, keyed by services account when known, otherwise by nick
+	User Limit
+	// Limit per target, the channel or, for private messages, the sender
+	Target Limit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	notified bool
+}
+
+// Allow reports whether m is within the limits and uses up a token if so.
+// With LimitQueue it blocks until tokens are available or the bot disconnects
+func (l *Limiter) Allow(bot *Bot, m *Message) bool {
+	userKey := "user " + bot.Casefold(m.Name)
+	if account, ok := m.GetTag("account"); ok && account != "" {
+		userKey = "account " + bot.Casefold(account)
+	} else if u, ok := bot.state.User(m.Name); ok && u.Account != "" {
+		userKey = "account " + bot.Casefold(u.Account)
+	}
+	targetKey := "target " + bot.Casefold(bot.replyTarget(m))
+	done := bot.doneChan()
+	for {
+		wait, limit, notify := l.take(userKey, targetKey)
+		if wait == 0 {
+			return true
+		}
+		switch limit.Action {
+		case LimitQueue:
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+			continue
+		case LimitNotify:
+			if notify {
+				notice := limit.Notice
+				if notice == "" {
+					notice = "slow down"
+				}
+				bot.Notice(m.Name, notice)
+			}
+		}
+		bot.Debug("rate limited", "from", m.Name, "to", m.To)
+		return false
+	}
+}
+
+// take uses a token from both buckets if they have one, otherwise
+// it returns how long to wait, the limit that was hit
+// and whether the sender should be notified
+func (l *Limiter) take(userKey, targetKey string) (wait time.Duration, limit Limit, notify bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	now := time.Now()
+	l.prune(now)
+	user := l.bucket(userKey, l.User, now)
+	target := l.bucket(targetKey, l.Target, now)
+	b, limit := user, l.User
+	if wait = user.wait(l.User); wait == 0 {
+		b, limit = target, l.Target
+		wait = target.wait(l.Target)
+	}
+	if wait > 0 {
+		notify = !b.notified
+		b.notified = true
+		return wait, limit, notify
+	}
+	for _, b := range []*bucket{user, target} {
+		if b != nil {
+			b.tokens--
+			b.notified = false
+		}
+	}
+	return 0, Limit{}, false
+}
+
+// bucket returns the refilled bucket of the key, nil if there is no limit
+func (l *Limiter) bucket(key string, limit Limit, now time.Time) *bucket {
+	if limit.Messages <= 0 || limit.Interval <= 0 {
+		return nil
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Messages), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(limit.Interval) * float64(limit.Messages)
+	if b.tokens > float64(limit.Messages) {
+		b.tokens = float64(limit.Messages)
+	}
+	b.last = now
+	return b
+}
+
+// wait returns how long until the bucket has a token
+func (b *bucket) wait(limit Limit) time.Duration {
+	if b == nil || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / float64(limit.Messages) * float64(limit.Interval))
+}
+
+// prune forgets buckets that have been idle long enough to be full again
+func (l *Limiter) prune(now time.Time) {
+	if len(l.buckets) < 1024 {
+		return
+	}
+	idle := l.User.Interval
+	if l.Target.Interval > idle {
+		idle = l.Target.Interval
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package kitty
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 100*time.Millisecond)
+	if !rl.drop() {
+		t.Fatal("new limiter has tokens")
+	}
+	rl.start()
+	defer rl.kill()
+	time.Sleep(250 * time.Millisecond)
+	// The bucket holds at most messageLimit tokens
+	for i := 0; i < 2; i++ {
+		if rl.drop() {
+			t.Fatalf("message %d dropped", i)
+		}
+	}
+	if !rl.drop() {
+		t.Fatal("third message not dropped")
+	}
+}
+
+// privmsg builds an incoming message as the reader would
+func privmsg(raw string) *Message {
+	m := parseMessage(raw)
+	m.Raw = raw
+	return m
+}
+
+func TestLimiterUser(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	l := &Limiter{User: Limit{Messages: 2, Interval: time.Second}}
+	alice := privmsg(":alice!a@h PRIVMSG #test :hi")
+	bob := privmsg(":bob!b@h PRIVMSG #test :hi")
+	for i := 0; i < 2; i++ {
+		if !l.Allow(bot, alice) {
+			t.Fatalf("message %d from alice refused", i)
+		}
+	}
+	if l.Allow(bot, alice) {
+		t.Fatal("third message from alice allowed")
+	}
+	if !l.Allow(bot, bob) {
+		t.Fatal("bob is limited by alice's messages")
+	}
+	// Account tags share one bucket between nicks
+	l = &Limiter{User: Limit{Messages: 1, Interval: time.Second}}
+	if !l.Allow(bot, privmsg("@account=cat :alice!a@h PRIVMSG #test :hi")) {
+		t.Fatal("first message refused")
+	}
+	if l.Allow(bot, privmsg("@account=cat :alice_!a@h PRIVMSG #test :hi")) {
+		t.Fatal("same account under another nick allowed")
+	}
+}
+
+func TestLimiterTarget(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	l := &Limiter{Target: Limit{Messages: 2, Interval: time.Second}}
+	for _, nick := range []string{"alice", "bob"} {
+		if !l.Allow(bot, privmsg(":"+nick+"!u@h PRIVMSG #test :hi")) {
+			t.Fatalf("%s refused", nick)
+		}
+	}
+	if l.Allow(bot, privmsg(":carol!u@h PRIVMSG #test :hi")) {
+		t.Fatal("third message to #test allowed")
+	}
+	if !l.Allow(bot, privmsg(":carol!u@h PRIVMSG #other :hi")) {
+		t.Fatal("#other is limited by #test")
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	l := &Limiter{User: Limit{Messages: 1, Interval: 50 * time.Millisecond}}
+	m := privmsg(":alice!a@h PRIVMSG #test :hi")
+	if !l.Allow(bot, m) || l.Allow(bot, m) {
+		t.Fatal("want one message allowed and the next refused")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !l.Allow(bot, m) {
+		t.Fatal("bucket didn't refill")
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	l := &Limiter{User: Limit{Messages: 1, Interval: 100 * time.Millisecond, Action: LimitQueue}}
+	m := privmsg(":alice!a@h PRIVMSG #test :hi")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.Allow(bot, m) {
+			t.Fatalf("message %d refused", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("three messages took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestLimiterNotify(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	l := &Limiter{User: Limit{Messages: 1, Interval: time.Minute, Action: LimitNotify, Notice: "easy"}}
+	m := privmsg(":alice!a@h PRIVMSG #test :hi")
+	for i := 0; i < 4; i++ {
+		l.Allow(bot, m)
+	}
+	bot.Msg("#test", "done")
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test :done$`); err != nil {
+		t.Fatal(err)
+	}
+	var notices int
+	for _, line := range c.Lines() {
+		if line == "NOTICE alice :easy" {
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Fatalf("sent %d notices, want one", notices)
+	}
+}
+
+func TestReplyLimiter(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.ReplyLimiter = &Limiter{User: Limit{Messages: 1, Interval: time.Minute}}
+	})
+	alice := privmsg(":alice!a@h PRIVMSG #test :hi")
+	bot.Reply(alice, "one")
+	bot.Reply(alice, "two")
+	bot.ReplyThread(alice, "three")
+	if err := bot.ReplyContext(context.Background(), alice, "four"); err != nil {
+		t.Fatal(err)
+	}
+	bot.Reply(privmsg(":bob!b@h PRIVMSG #test :hi"), "five")
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test :five$`); err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	for _, line := range c.Lines() {
+		if strings.HasPrefix(line, "PRIVMSG #test") {
+			sent = append(sent, line)
+		}
+	}
+	if len(sent) != 2 || sent[0] != "PRIVMSG #test :one" {
+		t.Fatalf("sent %q, want only one and five", sent)
+	}
+}
@@ -2,11 +2,11 @@
 
 package kitty
 
-func (bot *Bot) startUnixListener() {
-	bot.wg.Done()
+func (bot *Bot) startUnixListener() error {
+	return nil
 }
 
 // Attempt to hijack session previously running bot
-func (bot *Bot) hijackSession() bool {
-	return false
+func (bot *Bot) hijackSession() (bool, error) {
+	return false, nil
 }
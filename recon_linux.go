@@ -1,95 +1,85 @@
 package kitty
 
 import (
-	"bufio"
-	"encoding/json"
-	"io"
+	"errors"
 	"net"
 
 	"github.com/ftrvxmtrx/fd"
-	"github.com/ugjka/ircmsg"
 )
 
 // startUnixListener starts up a unix domain socket listener for reconnects to
 // be sent through
-func (bot *Bot) startUnixListener() {
-	defer bot.wg.Done()
+func (bot *Bot) startUnixListener() error {
 	unaddr, err := net.ResolveUnixAddr("unix", bot.unixastr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	list, err := net.ListenUnix("unix", unaddr)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	bot.mu.Lock()
 	bot.unixlist = list
 	bot.mu.Unlock()
 	con, err := list.AcceptUnix()
 	if err != nil {
-		return
+		// Closed by bot.close
+		return nil
 	}
 	defer con.Close()
 	list.Close()
 
-	fi, err := bot.con.(*net.TCPConn).File()
+	tcpcon, ok := bot.con.(*net.TCPConn)
+	if !ok {
+		return errors.New("can't hand over a non tcp connection")
+	}
+	fi, err := tcpcon.File()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	err = fd.Put(con, fi)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// Send own prefix and CAPs
-	_, err = io.WriteString(con, bot.Prefix().String()+"\n")
-	if err != nil {
-		panic(err)
-	}
-	err = json.NewEncoder(con).Encode(bot.capHandler.capsEnabled)
+	// Send own prefix, CAPs and channels
+	err = bot.writeHandover(con)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	bot.close("", nil)
 	bot.hijacked = true
+	return nil
 }
 
 // Attempt to hijack session previously running bot
-func (bot *Bot) hijackSession() bool {
+func (bot *Bot) hijackSession() (bool, error) {
 	con, err := net.Dial("unix", bot.unixastr)
 	if err != nil {
 		bot.Info("Couldnt restablish connection, no prior bot.", "err", err)
-		return false
+		return false, nil
 	}
 	defer con.Close()
 	ncon, err := fd.Get(con.(*net.UnixConn), 1, nil)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 	defer ncon[0].Close()
 
 	netcon, err := net.FileConn(ncon[0])
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 
-	// Read the reminder which should be our prefix and CAPs
-	sc := bufio.NewScanner(con)
-	if !sc.Scan() {
-		panic(sc.Err())
-	}
-	bot.prefixMu.Lock()
-	bot.prefix = ircmsg.ParsePrefix(sc.Text())
-	bot.prefixMu.Unlock()
-	if !sc.Scan() {
-		panic(sc.Err())
-	}
-	err = json.Unmarshal(sc.Bytes(), &bot.capHandler.capsEnabled)
+	// Read the reminder which should be our prefix, CAPs and channels
+	err = bot.readHandover(con)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 	bot.reconnecting = true
+	bot.mu.Lock()
 	bot.con = netcon
-	return true
+	bot.mu.Unlock()
+	return true, nil
 }
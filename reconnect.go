@@ -0,0 +1,145 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrReconnectAttempts is returned by RunForever
+// when ReconnectPolicy.MaxAttempts has been reached
+var ErrReconnectAttempts = errors.New("kitty: maximum reconnect attempts reached")
+
+// ReconnectPolicy configures the exponential backoff used by RunForever
+type ReconnectPolicy struct {
+	// Delay before the first reconnect attempt (default 5s)
+	MinDelay time.Duration
+	// Upper bound for the delay between attempts (default 5m)
+	MaxDelay time.Duration
+	// Delay multiplier applied after each failed attempt (default 2)
+	Factor float64
+	// Randomization of the delay, 0.2 means +/-20% (default 0.2)
+	Jitter float64
+	// Give up after this many consecutive failed attempts, 0 means never give up
+	MaxAttempts int
+	// A connection that lasted this long is considered stable
+	// and resets the backoff (default 5m)
+	StableAfter time.Duration
+}
+
+// delay returns the backoff for the given attempt, starting from 1
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+	d := float64(p.MinDelay)
+	factor := p.Factor
+	if factor < 1 {
+		factor = 1
+	}
+	for i := 1; i < attempt; i++ {
+		d *= factor
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// DisconnectCause describes why the bot lost its connection
+type DisconnectCause struct {
+	// Which part of the bot closed the connection,
+	// for example "incoming", "outgoing" or "connect".
+	// Empty if the bot was closed by the user
+	Fault string
+	// The error that caused the disconnect, if any
+	Err error
+}
+
+func (bot *Bot) setCause(fault string, err error) {
+	bot.mu.Lock()
+	bot.cause = DisconnectCause{Fault: fault, Err: err}
+	bot.mu.Unlock()
+}
+
+func (bot *Bot) getCause() DisconnectCause {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.cause
+}
+
+// RunForever runs the bot and reconnects with exponential backoff
+// according to bot.Reconnect whenever the connection is lost.
+// Cancelling ctx stops the bot gracefully, see Quit.
+// It returns nil when the bot gets hijacked or is stopped with Quit or Close,
+// ctx.Err() when ctx is cancelled, ErrReconnectAttempts when it gives up
+// and the registration error when retrying can't help,
+// like ErrBadPassword, ErrBanned or ErrSASLFailed
+func (bot *Bot) RunForever(ctx context.Context) error {
+	if bot.HijackSession && bot.SSL {
+		return ErrHijackSSL
+	}
+	var (
+		attempt int
+		cause   DisconnectCause
+	)
+	for {
+		if attempt > 0 && bot.OnReconnect != nil {
+			n, c := attempt, cause
+			bot.mu.Lock()
+			bot.afterWelcome = func() {
+				bot.OnReconnect(n, c)
+			}
+			bot.mu.Unlock()
+		}
+		hijacked := bot.run(ctx)
+		bot.mu.Lock()
+		bot.afterWelcome = nil
+		bot.mu.Unlock()
+		if hijacked {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cause = bot.getCause()
+		// Closed by the user
+		if cause == (DisconnectCause{}) {
+			return nil
+		}
+		bot.mu.Lock()
+		connectedAt := bot.connectedAt
+		bot.mu.Unlock()
+		if !connectedAt.IsZero() && time.Since(connectedAt) >= bot.Reconnect.StableAfter {
+			attempt = 0
+		}
+		if bot.OnDisconnect != nil {
+			go bot.OnDisconnect(cause)
+		}
+		if cause.Err != nil && !retryable(cause.Err) {
+			return cause.Err
+		}
+
+		attempt++
+		if bot.Reconnect.MaxAttempts > 0 && attempt > bot.Reconnect.MaxAttempts {
+			return ErrReconnectAttempts
+		}
+		delay := bot.Reconnect.delay(attempt)
+		bot.Info("reconnecting", "attempt", attempt, "delay", delay, "fault", cause.Fault, "err", cause.Err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package kitty
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// runForever runs the bot with RunForever and returns its result channel
+func runForever(t *testing.T, ctx context.Context, bot *Bot) chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() {
+		result <- bot.RunForever(ctx)
+	}()
+	t.Cleanup(func() {
+		bot.Close()
+	})
+	return result
+}
+
+func TestRunForeverReconnect(t *testing.T) {
+	srv := newServer(t)
+	type reconnect struct {
+		attempt    int
+		cause      DisconnectCause
+		registered bool
+	}
+	reconnected := make(chan reconnect, 1)
+	bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+		bot.ThrottleDelay = 0
+		bot.Reconnect.MinDelay = 10 * time.Millisecond
+		bot.OnReconnect = func(attempt int, cause DisconnectCause) {
+			reconnected <- reconnect{attempt, cause, bot.isRegistered()}
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := runForever(t, ctx, bot)
+	c, err := srv.NextClient(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitRegistered(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := srv.NextClient(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-reconnected:
+		if r.attempt != 1 || r.cause.Fault != "incoming" {
+			t.Fatalf("got attempt %d after %+v", r.attempt, r.cause)
+		}
+		if !r.registered {
+			t.Fatal("OnReconnect fired before the server welcomed the bot")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnReconnect didn't fire")
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunForever didn't return")
+	}
+}
+
+func TestRunForeverQuit(t *testing.T) {
+	for _, stop := range []string{"quit", "close"} {
+		srv := newServer(t)
+		bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+			bot.ThrottleDelay = 0
+			bot.Reconnect.MinDelay = 10 * time.Millisecond
+		})
+		result := runForever(t, context.Background(), bot)
+		c, err := srv.NextClient(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WaitRegistered(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if stop == "quit" {
+			bot.Quit("bye")
+		} else {
+			bot.Close()
+		}
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("%s: got %v, want nil", stop, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: RunForever didn't return", stop)
+		}
+		if _, err := srv.NextClient(100 * time.Millisecond); err == nil {
+			t.Fatalf("%s: the bot reconnected", stop)
+		}
+	}
+}
+
+func TestRunForeverHijackSSL(t *testing.T) {
+	bot := NewBot("irc.test:6697", "kittybot", func(bot *Bot) {
+		bot.HijackSession = true
+		bot.SSL = true
+	})
+	if err := bot.RunForever(context.Background()); err != ErrHijackSSL {
+		t.Fatalf("got %v, want ErrHijackSSL", err)
+	}
+}
@@ -0,0 +1,342 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoLabeledResponse is returned by Request for commands whose replies
+// can't be told apart without the labeled-response capability
+var ErrNoLabeledResponse = errors.New("kitty: command needs labeled-response")
+
+// Request sends a command and returns the replies to it.
+// With labeled-response the server tags the replies for us. Without it
+// replies are matched by the numerics that end them, one request at a time,
+// and commands with no known end return ErrNoLabeledResponse.
+// RequestTimeout applies if ctx has no deadline
+func (bot *Bot) Request(ctx context.Context, command string) ([]*Message, error) {
+	if err := validateLine(command); err != nil {
+		return nil, err
+	}
+	tags, command, err := splitTags(command)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok && bot.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bot.RequestTimeout)
+		defer cancel()
+	}
+	r := bot.requests
+	req := &request{done: make(chan []*Message, 1)}
+	defer r.remove(req)
+	if enabled, _ := bot.CapStatus(CapLabeledResponse); enabled {
+		r.mu.Lock()
+		r.next++
+		label := "kitty" + strconv.FormatUint(r.next, 36)
+		r.labels[label] = req
+		r.mu.Unlock()
+		return bot.await(ctx, req, "@"+strings.Join(append([]string{"label=" + label}, tags...), ";")+" "+command)
+	}
+
+	req.ends = bot.replyEnds(command)
+	if req.ends == nil {
+		return nil, ErrNoLabeledResponse
+	}
+	req.target = replyTarget(command)
+	select {
+	case r.unlabeled <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-r.unlabeled }()
+	r.mu.Lock()
+	r.current = req
+	r.mu.Unlock()
+	if len(tags) > 0 {
+		command = "@" + strings.Join(tags, ";") + " " + command
+	}
+	return bot.await(ctx, req, command)
+}
+
+// splitTags takes the tags off a raw line,
+// a label of its own can't be matched to our replies
+func splitTags(line string) (tags []string, command string, err error) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line, nil
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, "", fmt.Errorf("%w: tags without a command", ErrInvalidMessage)
+	}
+	for _, tag := range strings.Split(line[1:i], ";") {
+		if tag == "" {
+			continue
+		}
+		if key := strings.SplitN(tag, "=", 2)[0]; key == "label" {
+			return nil, "", fmt.Errorf("%w: line has its own label", ErrInvalidMessage)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, strings.TrimLeft(line[i:], " "), nil
+}
+
+// await sends the line and waits for the request to finish
+func (bot *Bot) await(ctx context.Context, req *request, line string) ([]*Message, error) {
+	done := bot.doneChan()
+	if err := bot.SendContext(ctx, line); err != nil {
+		return nil, err
+	}
+	select {
+	case replies := <-req.done:
+		return replies, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+		return nil, ErrClosed
+	}
+}
+
+type request struct {
+	// Numerics that end the reply, without labeled-response
+	ends map[string]bool
+	// What the end numeric names, empty if it doesn't
+	target  string
+	replies []*Message
+	done    chan []*Message
+}
+
+// requests matches replies to pending requests
+type requests struct {
+	mu      sync.Mutex
+	next    uint64
+	labels  map[string]*request
+	batches map[string]*request
+	current *request
+	// Only one request without a label can be in flight
+	unlabeled chan struct{}
+}
+
+func newRequests() *requests {
+	r := &requests{unlabeled: make(chan struct{}, 1)}
+	r.reset()
+	return r
+}
+
+func (r *requests) reset() {
+	r.mu.Lock()
+	r.labels = make(map[string]*request)
+	r.batches = make(map[string]*request)
+	r.current = nil
+	r.mu.Unlock()
+}
+
+// waiting reports whether a request waits for the label
+func (r *requests) waiting(label string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.labels[label]
+	return ok
+}
+
+func (r *requests) remove(req *request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for label, pending := range r.labels {
+		if pending == req {
+			delete(r.labels, label)
+		}
+	}
+	for ref, pending := range r.batches {
+		if pending == req {
+			delete(r.batches, ref)
+		}
+	}
+	if r.current == req {
+		r.current = nil
+	}
+}
+
+// Handle collects replies, it runs as an internal handler
+func (r *requests) Handle(bot *Bot, m *Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Completed != nil {
+		if req, ok := r.batches[m.Completed.Ref]; ok {
+			delete(r.batches, m.Completed.Ref)
+			req.done <- batchMessages(m.Completed, nil)
+		}
+		return
+	}
+	if label, ok := m.GetTag("label"); ok {
+		req, ok := r.labels[label]
+		if !ok {
+			return
+		}
+		delete(r.labels, label)
+		switch {
+		case m.Command == "BATCH" && strings.HasPrefix(m.Param(0), "+"):
+			r.batches[m.Param(0)[1:]] = req
+		case m.Command == "ACK":
+			req.done <- nil
+		default:
+			req.done <- []*Message{m}
+		}
+		return
+	}
+	if r.current == nil || !isNumeric(m.Command) {
+		return
+	}
+	req := r.current
+	// The end of a request that timed out before ours,
+	// what came so far was the rest of its reply
+	if req.target != "" && targetedEnds[m.Command] && !bot.EqualFold(m.Param(1), req.target) {
+		req.replies = nil
+		return
+	}
+	req.replies = append(req.replies, m)
+	if req.ends[m.Command] || requestErrors[m.Command] {
+		r.current = nil
+		req.done <- req.replies
+	}
+}
+
+// batchMessages flattens a batch, nested batches come after the parent's messages
+func batchMessages(b *Batch, list []*Message) []*Message {
+	list = append(list, b.Messages...)
+	for _, nested := range b.Batches {
+		list = batchMessages(nested, list)
+	}
+	return list
+}
+
+func isNumeric(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+	for _, c := range command {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Errors after which the server sends nothing else
+var requestErrors = map[string]bool{
+	"421": true, // unknown command
+	"451": true, // not registered
+	"461": true, // need more params
+	"481": true, // no privileges
+}
+
+// End numerics that name the target of the query
+var targetedEnds = map[string]bool{
+	"318": true, // end of WHOIS
+	"369": true, // end of WHOWAS
+	"315": true, // end of WHO
+	"366": true, // end of NAMES
+}
+
+// replyTarget returns what the end numeric of the command names,
+// empty if it doesn't name one or we can't tell
+func replyTarget(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) < 2 {
+		return ""
+	}
+	var target string
+	switch strings.ToUpper(fields[0]) {
+	case "WHOIS":
+		// WHOIS [server] nick
+		target = fields[len(fields)-1]
+	case "WHOWAS", "WHO", "NAMES":
+		target = fields[1]
+	}
+	target = strings.TrimPrefix(target, ":")
+	// Servers differ in how they name a list
+	if strings.Contains(target, ",") {
+		return ""
+	}
+	return target
+}
+
+// replyEnds returns the numerics that end the reply to the command,
+// nil if we can't tell
+func (bot *Bot) replyEnds(command string) map[string]bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	var ends []string
+	switch strings.ToUpper(fields[0]) {
+	case "WHOIS":
+		ends = []string{"318"}
+	case "WHOWAS":
+		ends = []string{"369"}
+	case "WHO":
+		ends = []string{"315"}
+	case "NAMES":
+		ends = []string{"366"}
+	case "LIST":
+		ends = []string{"323"}
+	case "MOTD":
+		ends = []string{"376", "422"}
+	case "ISON":
+		ends = []string{"303"}
+	case "USERHOST":
+		ends = []string{"302"}
+	case "TIME":
+		ends = []string{"391"}
+	case "VERSION":
+		ends = []string{"351"}
+	case "ADMIN":
+		ends = []string{"259"}
+	case "INFO":
+		ends = []string{"374"}
+	case "LINKS":
+		ends = []string{"365"}
+	case "STATS":
+		ends = []string{"219"}
+	case "MODE":
+		ends = bot.modeEnds(fields[1:])
+	}
+	if ends == nil {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, end := range ends {
+		set[end] = true
+	}
+	return set
+}
+
+// Only mode queries have a reply we can match
+func (bot *Bot) modeEnds(args []string) []string {
+	switch {
+	case len(args) == 0:
+		return nil
+	case len(args) == 1 && bot.isupport.IsChannel(args[0]):
+		// channel modes, no such channel
+		return []string{"324", "403"}
+	case len(args) == 1:
+		// user modes, not our nick
+		return []string{"221", "502"}
+	case len(args) == 2:
+		// list modes, not on channel, no such channel, not an op
+		errs := []string{"403", "442", "482"}
+		switch args[1] {
+		case "b", "+b":
+			return append(errs, "368")
+		case "e", "+e":
+			return append(errs, "349")
+		case "I", "+I":
+			return append(errs, "347")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package kitty
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// requestServer answers WHOIS, labeled when asked to, and records the lines it got
+func requestServer(t *testing.T, labeled bool) *kittytest.Server {
+	return newServer(t, func(srv *kittytest.Server) {
+		if labeled {
+			srv.Caps[CapBatch] = ""
+			srv.Caps[CapLabeledResponse] = ""
+		}
+		srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+			label, _ := m.GetTag("label")
+			switch m.Command {
+			case "WHOIS":
+				nick := m.Param(0)
+				lines := []string{
+					"311 kittybot " + nick + " u h * :" + nick,
+					"318 kittybot " + nick + " :End of /WHOIS list",
+				}
+				if label == "" {
+					// Slow enough for a second request to overtake if it could
+					delay := 20 * time.Millisecond
+					if nick == "slow" {
+						delay = 100 * time.Millisecond
+					}
+					time.Sleep(delay)
+					for _, line := range lines {
+						c.Send(":irc.test " + line)
+					}
+					return true
+				}
+				c.Send("@label=" + label + " :irc.test BATCH +" + label + " labeled-response")
+				for _, line := range lines {
+					c.Send("@batch=" + label + " :irc.test " + line)
+				}
+				c.Send(":irc.test BATCH -" + label)
+				return true
+			case "PING":
+				if label != "" {
+					c.Send("@label=" + label + " :irc.test PONG irc.test :" + m.Param(0))
+					return true
+				}
+			case "AWAY":
+				c.Send("@label=" + label + " :irc.test ACK")
+				return true
+			}
+			return false
+		}
+	})
+}
+
+func TestRequestLabeled(t *testing.T) {
+	srv := requestServer(t, true)
+	bot, c := startBot(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	replies, err := bot.Request(ctx, "WHOIS alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || replies[0].Command != "311" || replies[1].Command != "318" {
+		t.Fatalf("got %d replies for WHOIS", len(replies))
+	}
+	replies, err = bot.Request(ctx, "PING x")
+	if err != nil || len(replies) != 1 || replies[0].Command != "PONG" {
+		t.Fatalf("PING: %v, %d replies", err, len(replies))
+	}
+	replies, err = bot.Request(ctx, "AWAY")
+	if err != nil || len(replies) != 0 {
+		t.Fatalf("AWAY: %v, %d replies", err, len(replies))
+	}
+
+	// Tags of the command are kept next to the label
+	if _, err := bot.Request(ctx, "@+draft/x=1 PING y"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Expect(time.Second, `^@label=[^ ;]+;\+draft/x=1 PING y$`); err != nil {
+		t.Fatalf("tags not merged: %v", err)
+	}
+	if _, err := bot.Request(ctx, "@label=mine PING z"); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("command with its own label: %v, want ErrInvalidMessage", err)
+	}
+}
+
+func TestRequestUnlabeled(t *testing.T) {
+	srv := requestServer(t, false)
+	joined := make(chan struct{}, 1)
+	bot, _ := startBot(t, srv, func(bot *Bot) {
+		// Numerics from the connection would end up in the first request
+		bot.AddTrigger(Trigger{
+			Condition: func(bot *Bot, m *Message) bool { return m.Command == "366" },
+			Action: func(bot *Bot, m *Message) {
+				select {
+				case joined <- struct{}{}:
+				default:
+				}
+			},
+		})
+	})
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatal("the bot didn't join")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := bot.Request(ctx, "PING x"); !errors.Is(err, ErrNoLabeledResponse) {
+		t.Fatalf("PING: %v, want ErrNoLabeledResponse", err)
+	}
+	// Concurrent requests are sent one at a time and get their own replies
+	type result struct {
+		nick    string
+		replies []*Message
+		err     error
+	}
+	results := make(chan result, 3)
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		nick := nick
+		go func() {
+			replies, err := bot.Request(ctx, "WHOIS "+nick)
+			results <- result{nick, replies, err}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if len(r.replies) != 2 {
+			t.Fatalf("%s got %d replies, want 2", r.nick, len(r.replies))
+		}
+		for _, m := range r.replies {
+			if m.Param(1) != r.nick {
+				t.Fatalf("%s got a reply about %s", r.nick, m.Param(1))
+			}
+		}
+	}
+
+	// The end numeric of NAMES comes from kittytest itself
+	replies, err := bot.Request(ctx, "NAMES #test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := replies[len(replies)-1]; last.Command != "366" {
+		t.Fatalf("NAMES ended with %s", last.Command)
+	}
+	// Unknown commands end with 421
+	replies, err = bot.Request(ctx, "MODE #test b")
+	if err != nil || len(replies) != 1 || replies[0].Command != "421" {
+		t.Fatalf("MODE: %v, %d replies", err, len(replies))
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	srv := requestServer(t, true)
+	bot, _ := startBot(t, srv)
+	bot.RequestTimeout = 50 * time.Millisecond
+	// kittytest answers unknown commands with an unlabeled 421
+	if _, err := bot.Request(context.Background(), "FOO"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+func TestRequestStale(t *testing.T) {
+	srv := requestServer(t, false)
+	bot, _ := startBot(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err := bot.Request(ctx, "WHOIS slow")
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	// The late reply to slow isn't ours
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	replies, err := bot.Request(ctx, "WHOIS Kitty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("got %d replies, want 2", len(replies))
+	}
+	for _, m := range replies {
+		if m.Param(1) != "Kitty" {
+			t.Fatalf("got a reply about %s", m.Param(1))
+		}
+	}
+}
+
+func TestReplyTarget(t *testing.T) {
+	tests := map[string]string{
+		"WHOIS kitty":          "kitty",
+		"WHOIS irc.test kitty": "kitty",
+		"WHOIS :kitty":         "kitty",
+		"WHO #cats %tnuhraf,1": "#cats",
+		"NAMES #cats":          "#cats",
+		"NAMES #cats,#dogs":    "",
+		"WHOWAS kitty 5":       "kitty",
+		"LIST":                 "",
+		"MODE #cats":           "",
+	}
+	for command, want := range tests {
+		if got := replyTarget(command); got != want {
+			t.Errorf("replyTarget(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
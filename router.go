@@ -0,0 +1,306 @@
+package kitty
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Router is a Handler that dispatches chat commands like "!info"
+// or "kittybot: info" to registered Commands.
+// It answers "help" with a list of the commands and their usage
+type Router struct {
+	// Command prefix, for example "!" or "-"
+	Prefix string
+	// Also accept commands addressed to the bot, like "kittybot: info"
+	Addressed bool
+	// Decides whether the sender of m has the permission
+	// that a command requires. If nil, such commands are refused
+	Permission func(bot *Bot, m *Message, permission string) bool
+	// Rate limits commands, nil means no limit
+	Limiter *Limiter
+
+	mu       sync.RWMutex
+	commands map[string]*Command
+	lastUsed map[*Command]time.Time
+}
+
+// Command is a command registered with a Router
+type Command struct {
+	// Name of the command, matched case-insensitively
+	Name string
+	// Other names for the command
+	Aliases []string
+	// Short description shown by help
+	Help string
+	// Arguments of the command
+	Args []Arg
+	// Overrides the usage string generated from Args
+	Usage string
+	// Permission the sender needs, see Router.Permission
+	Permission string
+	// Minimum time between uses of the command
+	Cooldown time.Duration
+	// Action receives the arguments in the order of Args,
+	// missing optional arguments are left out
+	Action func(bot *Bot, m *Message, args []string)
+}
+
+// Arg describes a command argument.
+// Arguments are separated by spaces and can be quoted with " or '
+type Arg struct {
+	Name string
+	// Optional arguments can be left out, they must come after required ones
+	Optional bool
+	// Rest takes the remaining text as is, it must be the last argument
+	Rest bool
+}
+
+// NewRouter creates a command router with the given command prefix
+func NewRouter(prefix string) *Router {
+	return &Router{
+		Prefix:   prefix,
+		commands: make(map[string]*Command),
+		lastUsed: make(map[*Command]time.Time),
+	}
+}
+
+// Add registers a command, it fails if the name or an alias is taken
+func (r *Router) Add(cmd Command) error {
+	if cmd.Name == "" || cmd.Action == nil {
+		return errors.New("kitty: command needs a name and an action")
+	}
+	for i, arg := range cmd.Args {
+		if arg.Rest && i != len(cmd.Args)-1 {
+			return fmt.Errorf("kitty: command %s: rest argument must be the last", cmd.Name)
+		}
+		if i > 0 && cmd.Args[i-1].Optional && !arg.Optional {
+			return fmt.Errorf("kitty: command %s: required argument after optional", cmd.Name)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.commands == nil {
+		r.commands = make(map[string]*Command)
+		r.lastUsed = make(map[*Command]time.Time)
+	}
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, name := range names {
+		if _, ok := r.commands[strings.ToLower(name)]; ok {
+			return fmt.Errorf("kitty: command %s already registered", name)
+		}
+	}
+	c := &cmd
+	for _, name := range names {
+		r.commands[strings.ToLower(name)] = c
+	}
+	return nil
+}
+
+// Remove unregisters a command and its aliases
+func (r *Router) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.commands[strings.ToLower(name)]
+	if !ok {
+		return
+	}
+	for key, cmd := range r.commands {
+		if cmd == c {
+			delete(r.commands, key)
+		}
+	}
+	delete(r.lastUsed, c)
+}
+
+// Handle implements Handler
+func (r *Router) Handle(bot *Bot, m *Message) {
+	if m.Command != "PRIVMSG" || m.IsCTCP() {
+		return
+	}
+	line, ok := r.strip(bot, m.Content)
+	if !ok {
+		return
+	}
+	split := strings.SplitN(line, " ", 2)
+	name := strings.ToLower(split[0])
+	var rest string
+	if len(split) == 2 {
+		rest = strings.TrimSpace(split[1])
+	}
+
+	r.mu.RLock()
+	cmd, ok := r.commands[name]
+	r.mu.RUnlock()
+	if !ok && name != "help" {
+		return
+	}
+	if r.Limiter != nil && !r.Limiter.Allow(bot, m) {
+		return
+	}
+	if !ok {
+		r.help(bot, m, rest)
+		return
+	}
+
+	if !r.permitted(bot, m, cmd) {
+		bot.Reply(m, fmt.Sprintf("%s: you are not allowed to use %s", m.Name, cmd.Name))
+		return
+	}
+	args, err := parseArgs(rest, cmd.Args)
+	if err != nil {
+		bot.Reply(m, "usage: "+r.usage(cmd))
+		return
+	}
+	if cmd.Cooldown > 0 {
+		r.mu.Lock()
+		last := r.lastUsed[cmd]
+		if time.Since(last) < cmd.Cooldown {
+			r.mu.Unlock()
+			bot.Debug("command on cooldown", "command", cmd.Name, "from", m.Name)
+			return
+		}
+		r.lastUsed[cmd] = time.Now()
+		r.mu.Unlock()
+	}
+	cmd.Action(bot, m, args)
+}
+
+// strip removes the prefix or the bot's nick from a command line
+func (r *Router) strip(bot *Bot, text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if r.Prefix != "" && strings.HasPrefix(text, r.Prefix) {
+		text = strings.TrimPrefix(text, r.Prefix)
+		return text, text != "" && text[0] != ' '
+	}
+	if r.Addressed {
+		nick := bot.getNick()
+		if len(text) > len(nick)+1 && bot.EqualFold(text[:len(nick)], nick) &&
+			(text[len(nick)] == ':' || text[len(nick)] == ',') {
+			text = strings.TrimSpace(text[len(nick)+1:])
+			return text, text != ""
+		}
+	}
+	return "", false
+}
+
+func (r *Router) permitted(bot *Bot, m *Message, cmd *Command) bool {
+	if cmd.Permission == "" {
+		return true
+	}
+	return r.Permission != nil && r.Permission(bot, m, cmd.Permission)
+}
+
+// usage returns the usage string of a command
+func (r *Router) usage(cmd *Command) string {
+	if cmd.Usage != "" {
+		return cmd.Usage
+	}
+	usage := r.Prefix + cmd.Name
+	for _, arg := range cmd.Args {
+		name := arg.Name
+		if arg.Rest {
+			name += "..."
+		}
+		if arg.Optional {
+			usage += " [" + name + "]"
+		} else {
+			usage += " <" + name + ">"
+		}
+	}
+	return usage
+}
+
+// help answers the built-in help command
+func (r *Router) help(bot *Bot, m *Message, topic string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if topic != "" {
+		cmd, ok := r.commands[strings.ToLower(strings.TrimPrefix(topic, r.Prefix))]
+		if !ok || !r.permitted(bot, m, cmd) {
+			bot.Reply(m, "no such command: "+topic)
+			return
+		}
+		text := "usage: " + r.usage(cmd)
+		if len(cmd.Aliases) > 0 {
+			text += " (aliases: " + strings.Join(cmd.Aliases, ", ") + ")"
+		}
+		if cmd.Help != "" {
+			text += " - " + cmd.Help
+		}
+		bot.Reply(m, text)
+		return
+	}
+	var names []string
+	for key, cmd := range r.commands {
+		if key == strings.ToLower(cmd.Name) && r.permitted(bot, m, cmd) {
+			names = append(names, cmd.Name)
+		}
+	}
+	sort.Strings(names)
+	bot.Reply(m, fmt.Sprintf("commands: %s (use %shelp <command> for details)",
+		strings.Join(names, ", "), r.Prefix))
+}
+
+// parseArgs splits the argument text according to spec
+func parseArgs(text string, spec []Arg) ([]string, error) {
+	var args []string
+	for i, arg := range spec {
+		text = strings.TrimLeft(text, " ")
+		if text == "" {
+			if arg.Optional {
+				break
+			}
+			return nil, errors.New("missing argument " + arg.Name)
+		}
+		if arg.Rest {
+			args = append(args, text)
+			text = ""
+			break
+		}
+		token, rest, err := nextToken(text)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, token)
+		text = rest
+		if i == len(spec)-1 && strings.TrimSpace(text) != "" {
+			return nil, errors.New("too many arguments")
+		}
+	}
+	if len(spec) == 0 && strings.TrimSpace(text) != "" {
+		return nil, errors.New("too many arguments")
+	}
+	return args, nil
+}
+
+// nextToken returns the first, possibly quoted, word of text
+func nextToken(text string) (token, rest string, err error) {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(text):
+			i++
+			b.WriteByte(text[i])
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			b.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ':
+			return b.String(), text[i+1:], nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote != 0 {
+		return "", "", errors.New("unterminated quote")
+	}
+	return b.String(), "", nil
+}
@@ -0,0 +1,111 @@
+package kitty
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	nick := Arg{Name: "nick"}
+	optional := Arg{Name: "reason", Optional: true}
+	rest := Arg{Name: "text", Optional: true, Rest: true}
+	tests := []struct {
+		text string
+		spec []Arg
+		want []string
+		err  bool
+	}{
+		{"", nil, nil, false},
+		{"extra", nil, nil, true},
+		{"bob", []Arg{nick}, []string{"bob"}, false},
+		{"  bob  ", []Arg{nick}, []string{"bob"}, false},
+		{"", []Arg{nick}, nil, true},
+		{"bob alice", []Arg{nick}, nil, true},
+		{"bob", []Arg{nick, optional}, []string{"bob"}, false},
+		{`bob "being rude"`, []Arg{nick, optional}, []string{"bob", "being rude"}, false},
+		{`bob 'being "rude"'`, []Arg{nick, optional}, []string{"bob", `being "rude"`}, false},
+		{`bob being\ rude`, []Arg{nick, optional}, []string{"bob", "being rude"}, false},
+		{`'bob'smith`, []Arg{nick}, []string{"bobsmith"}, false},
+		{`bob "unterminated`, []Arg{nick, optional}, nil, true},
+		{`bob  all of "this" stays`, []Arg{nick, rest}, []string{"bob", `all of "this" stays`}, false},
+		{"bob", []Arg{nick, rest}, []string{"bob"}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseArgs(tt.text, tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: err %v, want error %v", tt.text, err, tt.err)
+			continue
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRouterAdd(t *testing.T) {
+	r := NewRouter("!")
+	action := func(*Bot, *Message, []string) {}
+	if err := r.Add(Command{Name: "kick", Aliases: []string{"k"}, Action: action}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(Command{Name: "K", Action: action}); err == nil {
+		t.Error("alias taken twice")
+	}
+	if err := r.Add(Command{Name: "a", Args: []Arg{{Name: "x", Rest: true}, {Name: "y"}}, Action: action}); err == nil {
+		t.Error("rest argument before the last accepted")
+	}
+	if err := r.Add(Command{Name: "b", Args: []Arg{{Name: "x", Optional: true}, {Name: "y"}}, Action: action}); err == nil {
+		t.Error("required argument after optional accepted")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	srv := newServer(t)
+	r := NewRouter("!")
+	r.Addressed = true
+	got := make(chan []string, 4)
+	r.Add(Command{
+		Name:       "kick",
+		Args:       []Arg{{Name: "nick"}, {Name: "reason", Optional: true, Rest: true}},
+		Permission: "op",
+		Action: func(bot *Bot, m *Message, args []string) {
+			got <- args
+		},
+	})
+	r.Permission = func(bot *Bot, m *Message, permission string) bool {
+		return m.Name == "ugjka" && permission == "op"
+	}
+	bot, c := startBot(t, srv)
+	bot.AddTrigger(r)
+
+	c.Send(`:ugjka!u@h PRIVMSG #test :!kick bob "too loud" really`)
+	c.Send(`:ugjka!u@h PRIVMSG #test :KittyBot, KICK 'alice'`)
+	// Triggers run concurrently, the order of the two is not fixed
+	want := map[string]bool{`bob|"too loud" really`: true, "alice": true}
+	for i := 0; i < 2; i++ {
+		select {
+		case args := <-got:
+			if !want[strings.Join(args, "|")] {
+				t.Fatalf("got %q, want one of %v", args, want)
+			}
+			delete(want, strings.Join(args, "|"))
+		case <-time.After(time.Second):
+			t.Fatal("command didn't run")
+		}
+	}
+
+	c.Send(`:ugjka!u@h PRIVMSG #test :!kick`)
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test :usage: !kick <nick> \[reason\.\.\.\]$`); err != nil {
+		t.Fatal(err)
+	}
+	c.Send(`:bob!u@h PRIVMSG #test :!kick ugjka`)
+	if _, err := c.Expect(time.Second, `^PRIVMSG #test :bob: you are not allowed to use kick$`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case args := <-got:
+		t.Fatalf("command ran with %q", args)
+	default:
+	}
+}
@@ -0,0 +1,240 @@
+package kitty
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SASLMechanism is a SASL authentication mechanism.
+// Set Bot.SASLMechanism to use your own.
+// Mechanisms that also authenticate the server can implement
+// Done() bool, a success (903) is only accepted once it returns true
+type SASLMechanism interface {
+	// Name as sent in AUTHENTICATE, for example "PLAIN"
+	Name() string
+	// Next returns the response to a server challenge.
+	// The first challenge of every exchange is empty,
+	// mechanisms should start over when they see it
+	Next(challenge []byte) (response []byte, err error)
+}
+
+// saslCompleter is the optional Done method of SASLMechanism
+type saslCompleter interface {
+	Done() bool
+}
+
+// SASL mechanisms
+const (
+	SASLPlain       = "PLAIN"
+	SASLExternal    = "EXTERNAL"
+	SASLScramSHA1   = "SCRAM-SHA-1"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+)
+
+// SASLError is the error the bot closes with
+// when SASL authentication fails for good
+type SASLError struct {
+	Mechanism string
+	// The numeric reply, like 904, empty if the failure was on our side
+	Numeric string
+	Message string
+}
+
+func (e *SASLError) Error() string {
+	if e.Numeric == "" {
+		return fmt.Sprintf("kitty: sasl %s failed: %s", e.Mechanism, e.Message)
+	}
+	return fmt.Sprintf("kitty: sasl %s failed (%s): %s", e.Mechanism, e.Numeric, e.Message)
+}
+
+// NewSASLMechanism returns one of the built-in mechanisms by name,
+// or nil if there is no such mechanism
+func NewSASLMechanism(name, user, pass string) SASLMechanism {
+	switch strings.ToUpper(name) {
+	case SASLPlain:
+		return &saslPlain{user: user, pass: pass}
+	case SASLExternal:
+		return saslExternal{}
+	case SASLScramSHA1:
+		return &saslScram{name: SASLScramSHA1, hash: sha1.New, user: user, pass: pass}
+	case SASLScramSHA256:
+		return &saslScram{name: SASLScramSHA256, hash: sha256.New, user: user, pass: pass}
+	}
+	return nil
+}
+
+type saslPlain struct {
+	user, pass string
+}
+
+func (p *saslPlain) Name() string {
+	return SASLPlain
+}
+
+func (p *saslPlain) Next([]byte) ([]byte, error) {
+	return bytes.Join([][]byte{[]byte(p.user), []byte(p.user), []byte(p.pass)}, []byte{0}), nil
+}
+
+// The server authenticates us by the TLS client certificate
+type saslExternal struct{}
+
+func (saslExternal) Name() string {
+	return SASLExternal
+}
+
+// Empty authzid
+func (saslExternal) Next([]byte) ([]byte, error) {
+	return nil, nil
+}
+
+// saslScram implements SCRAM, RFC 5802 and 7677.
+// The password is used as is, without SASLprep
+type saslScram struct {
+	name       string
+	hash       func() hash.Hash
+	user, pass string
+
+	step        int
+	clientNonce string
+	clientFirst string
+	serverSig   []byte
+	// Set once the server signature checks out
+	verified bool
+}
+
+func (s *saslScram) Name() string {
+	return s.name
+}
+
+func (s *saslScram) Next(challenge []byte) ([]byte, error) {
+	if len(challenge) == 0 {
+		s.step = 0
+		s.verified = false
+	}
+	s.step++
+	switch s.step {
+	case 1:
+		nonce := make([]byte, 18)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		s.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+		s.clientFirst = "n=" + scramName(s.user) + ",r=" + s.clientNonce
+		return []byte("n,," + s.clientFirst), nil
+	case 2:
+		return s.clientFinal(string(challenge))
+	case 3:
+		attrs := scramAttrs(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, errors.New("server error: " + e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(sig, s.serverSig) {
+			return nil, errors.New("invalid server signature")
+		}
+		s.verified = true
+		return nil, nil
+	}
+	return nil, errors.New("unexpected challenge")
+}
+
+// Done reports whether the server has proven it knows the password
+func (s *saslScram) Done() bool {
+	return s.verified
+}
+
+func (s *saslScram) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttrs(serverFirst)
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, s.clientNonce) || len(nonce) == len(s.clientNonce) {
+		return nil, errors.New("invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid salt")
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return nil, errors.New("invalid iteration count")
+	}
+
+	salted := pbkdf2(s.hash, []byte(s.pass), salt, iter)
+	clientKey := hmacSum(s.hash, salted, []byte("Client Key"))
+	h := s.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	// c=biws is base64 of the "n,," gs2 header
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(s.clientFirst + "," + serverFirst + "," + withoutProof)
+	proof := hmacSum(s.hash, storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSig = hmacSum(s.hash, hmacSum(s.hash, salted, []byte("Server Key")), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// scramName escapes = and , in the username
+func scramName(user string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+}
+
+// scramAttrs splits a SCRAM message like "r=abc,s=def,i=4096"
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 1 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+func hmacSum(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a single block key, which is all SCRAM needs
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := make([]byte, len(u))
+	copy(out, u)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// authenticateLines encodes a SASL response into AUTHENTICATE lines,
+// split into 400 byte chunks, followed by "+" if the last chunk was full
+func authenticateLines(response []byte) []string {
+	payload := base64.StdEncoding.EncodeToString(response)
+	var lines []string
+	for len(payload) >= 400 {
+		lines = append(lines, "AUTHENTICATE "+payload[:400])
+		payload = payload[400:]
+	}
+	if payload == "" {
+		return append(lines, "AUTHENTICATE +")
+	}
+	return append(lines, "AUTHENTICATE "+payload)
+}
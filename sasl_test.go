@@ -0,0 +1,280 @@
+package kitty
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugjka/ircmsg"
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// Exchanges from RFC 5802 section 5 and RFC 7677 section 3
+var scramVectors = []struct {
+	name        string
+	hash        func() hash.Hash
+	clientNonce string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		SASLScramSHA1, sha1.New,
+		"fyko+d2lbbFgONRv9qkxdawL",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		SASLScramSHA256, sha256.New,
+		"rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+// scramAt returns a mechanism that sent its client-first message with the given nonce
+func scramAt(name string, h func() hash.Hash, nonce string) *saslScram {
+	return &saslScram{
+		name: name, hash: h, user: "user", pass: "pencil",
+		step:        1,
+		clientNonce: nonce,
+		clientFirst: "n=user,r=" + nonce,
+	}
+}
+
+func TestScramVectors(t *testing.T) {
+	for _, v := range scramVectors {
+		s := scramAt(v.name, v.hash, v.clientNonce)
+		final, err := s.Next([]byte(v.serverFirst))
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if string(final) != v.clientFinal {
+			t.Fatalf("%s: client final is %q, want %q", v.name, final, v.clientFinal)
+		}
+		if s.Done() {
+			t.Fatalf("%s: done before the server signature", v.name)
+		}
+		if _, err := s.Next([]byte(v.serverFinal)); err != nil {
+			t.Fatalf("%s: server signature rejected: %v", v.name, err)
+		}
+		if !s.Done() {
+			t.Fatalf("%s: not done after the server signature", v.name)
+		}
+	}
+}
+
+func TestScramServerSignature(t *testing.T) {
+	for _, v := range scramVectors {
+		for _, bad := range []string{"v=" + base64.StdEncoding.EncodeToString(make([]byte, v.hash().Size())), "v=not base64", "e=invalid-proof"} {
+			s := scramAt(v.name, v.hash, v.clientNonce)
+			if _, err := s.Next([]byte(v.serverFirst)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Next([]byte(bad)); err == nil {
+				t.Errorf("%s: server final %q accepted", v.name, bad)
+			}
+		}
+	}
+}
+
+func TestScramBadServerFirst(t *testing.T) {
+	v := scramVectors[0]
+	for _, bad := range []string{
+		"r=someoneelse,s=QSXCR+Q6sek8bf92,i=4096",
+		"r=" + v.clientNonce + ",s=QSXCR+Q6sek8bf92,i=4096",
+		"r=" + v.clientNonce + "x,s=,i=4096",
+		"r=" + v.clientNonce + "x,s=QSXCR+Q6sek8bf92,i=0",
+	} {
+		s := scramAt(v.name, v.hash, v.clientNonce)
+		if _, err := s.Next([]byte(bad)); err == nil {
+			t.Errorf("server first %q accepted", bad)
+		}
+	}
+}
+
+func TestSASLScram(t *testing.T) {
+	for _, mech := range []string{SASLScramSHA1, SASLScramSHA256} {
+		t.Run(mech, func(t *testing.T) {
+			srv := newServer(t, func(srv *kittytest.Server) {
+				srv.Accounts["kittybot"] = "pen,cil="
+			})
+			_, c := startBot(t, srv, func(bot *Bot) {
+				bot.SASL = true
+				bot.Password = "pen,cil="
+				bot.SASLMech = mech
+			})
+			if _, err := c.Expect(time.Second, `^AUTHENTICATE `+mech+`$`); err != nil {
+				t.Fatal(err)
+			}
+			if c.Account() != "kittybot" {
+				t.Fatalf("logged in as %q", c.Account())
+			}
+		})
+	}
+}
+
+// echoMech answers every challenge with the same response
+type echoMech struct {
+	response   []byte
+	challenges chan []byte
+}
+
+func (e *echoMech) Name() string {
+	return "X-ECHO"
+}
+
+func (e *echoMech) Next(challenge []byte) ([]byte, error) {
+	e.challenges <- challenge
+	return e.response, nil
+}
+
+func TestAuthenticateLines(t *testing.T) {
+	tests := []struct {
+		size  int
+		lines []int
+	}{
+		{0, nil},
+		{1, []int{4}},
+		{299, []int{400}},
+		{300, []int{400}},
+		{301, []int{400, 4}},
+		{600, []int{400, 400}},
+	}
+	for _, tt := range tests {
+		response := bytes.Repeat([]byte{0xff}, tt.size)
+		lines := authenticateLines(response)
+		var payload string
+		for i, line := range lines {
+			chunk := strings.TrimPrefix(line, "AUTHENTICATE ")
+			if i < len(tt.lines) {
+				if len(chunk) != tt.lines[i] {
+					t.Errorf("%d bytes: line %d is %d long, want %d", tt.size, i, len(chunk), tt.lines[i])
+				}
+				payload += chunk
+			} else if i > len(tt.lines) || chunk != "+" {
+				t.Errorf("%d bytes: extra line %q", tt.size, line)
+			}
+		}
+		// A "+" ends a payload that is empty or a multiple of 400
+		full := len(tt.lines) == 0 || tt.lines[len(tt.lines)-1] == 400
+		if full && lines[len(lines)-1] != "AUTHENTICATE +" {
+			t.Errorf("%d bytes: no closing +", tt.size)
+		}
+		if decoded, _ := base64.StdEncoding.DecodeString(payload); !bytes.Equal(decoded, response) {
+			t.Errorf("%d bytes: payload doesn't decode to the response", tt.size)
+		}
+	}
+}
+
+func TestAuthenticateChunks(t *testing.T) {
+	challenge := bytes.Repeat([]byte("c"), 450)
+	mech := &echoMech{response: bytes.Repeat([]byte("r"), 600), challenges: make(chan []byte, 2)}
+	responses := make(chan []byte, 2)
+	var buf string
+	var answered int
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+			if m.Command != "AUTHENTICATE" {
+				return false
+			}
+			if m.Param(0) == mech.Name() {
+				c.Send("AUTHENTICATE +")
+				return true
+			}
+			if m.Param(0) != "+" {
+				buf += m.Param(0)
+			}
+			if len(m.Param(0)) == 400 {
+				return true
+			}
+			response, _ := base64.StdEncoding.DecodeString(buf)
+			buf = ""
+			responses <- response
+			if answered++; answered == 1 {
+				// 600 base64 bytes, sent as 400 and 200
+				payload := base64.StdEncoding.EncodeToString(challenge)
+				c.Send("AUTHENTICATE " + payload[:400])
+				c.Send("AUTHENTICATE " + payload[400:])
+				return true
+			}
+			c.Send(":irc.test 903 * :SASL authentication successful")
+			return true
+		}
+	})
+	startBot(t, srv, func(bot *Bot) {
+		bot.SASL = true
+		bot.SASLMechanism = mech
+	})
+	for i, want := range [][]byte{nil, challenge} {
+		if got := <-mech.challenges; !bytes.Equal(got, want) {
+			t.Fatalf("challenge %d is %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-responses; !bytes.Equal(got, mech.response) {
+			t.Fatalf("response %d is %d bytes, want %d", i, len(got), len(mech.response))
+		}
+	}
+}
+
+func TestSASLFailed(t *testing.T) {
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.Accounts["kittybot"] = "right"
+	})
+	bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+		bot.ThrottleDelay = 0
+		bot.SASL = true
+		bot.Password = "wrong"
+		bot.SASLMech = SASLPlain
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := bot.RunContext(ctx)
+	if !errors.Is(err, ErrSASLFailed) {
+		t.Fatalf("got %v, want ErrSASLFailed", err)
+	}
+	var saslErr *SASLError
+	if !errors.As(err, &saslErr) || saslErr.Numeric != "904" || saslErr.Mechanism != SASLPlain {
+		t.Fatalf("got %#v, want a 904 for PLAIN", err)
+	}
+}
+
+func TestSASLSuccessTooEarly(t *testing.T) {
+	// The server says 903 without sending its signature
+	srv := newServer(t, func(srv *kittytest.Server) {
+		srv.Handler = func(c *kittytest.Client, m *ircmsg.Message) bool {
+			if m.Command != "AUTHENTICATE" {
+				return false
+			}
+			if m.Param(0) == SASLScramSHA256 {
+				c.Send("AUTHENTICATE +")
+				return true
+			}
+			c.Send(":irc.test 903 * :SASL authentication successful")
+			return true
+		}
+	})
+	bot := NewBot(srv.Addr(), "kittybot", func(bot *Bot) {
+		bot.ThrottleDelay = 0
+		bot.SASL = true
+		bot.Password = "pencil"
+		bot.SASLMech = SASLScramSHA256
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := bot.RunContext(ctx)
+	var saslErr *SASLError
+	if !errors.As(err, &saslErr) || saslErr.Numeric != "903" {
+		t.Fatalf("got %v, want a SASLError for 903", err)
+	}
+}
@@ -0,0 +1,116 @@
+package kitty
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Commands that keep the connection alive or registration going,
+// they skip ahead of queued messages
+var priorityCommands = map[string]struct{}{
+	"PONG":         {},
+	"PING":         {},
+	"CAP":          {},
+	"AUTHENTICATE": {},
+	"PASS":         {},
+	"USER":         {},
+	"NICK":         {},
+}
+
+// queuedLine is a line waiting in a send queue
+type queuedLine struct {
+	line string
+	// Resolved when the line is written, can be nil
+	delivery *Delivery
+}
+
+// lane returns the queue the line goes to
+func (bot *Bot) lane(line string) chan queuedLine {
+	command := line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		command = line[:i]
+	}
+	if _, ok := priorityCommands[strings.ToUpper(command)]; ok {
+		return bot.priority
+	}
+	return bot.outgoing
+}
+
+// enqueue queues the line unless done is closed. Lines that make it in
+// after done is closed are failed by the writer on its way out,
+// it takes queueMu so it waits for us
+func (bot *Bot) enqueue(ctx context.Context, done chan struct{}, q queuedLine) error {
+	bot.queueMu.RLock()
+	defer bot.queueMu.RUnlock()
+	select {
+	case <-done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case bot.lane(q.line) <- q:
+		return nil
+	case <-done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendable returns the done channel of the connection,
+// ErrClosed once it is gone and ErrShuttingDown while we quit
+func (bot *Bot) sendable() (chan struct{}, error) {
+	bot.mu.Lock()
+	quitting, done := bot.quitting, bot.done
+	bot.mu.Unlock()
+	select {
+	case <-done:
+		return nil, ErrClosed
+	default:
+	}
+	if quitting {
+		return nil, ErrShuttingDown
+	}
+	return done, nil
+}
+
+// dropQueued empties the queues, failing pending deliveries
+func (bot *Bot) dropQueued() {
+	for {
+		select {
+		case q := <-bot.outgoing:
+			q.delivery.resolve(ErrClosed)
+		case q := <-bot.priority:
+			q.delivery.resolve(ErrClosed)
+		default:
+			return
+		}
+	}
+}
+
+// QueueLen returns the number of lines waiting to be sent,
+// protocol traffic and everything else
+func (bot *Bot) QueueLen() (priority, normal int) {
+	return len(bot.priority), len(bot.outgoing)
+}
+
+// throttle implements the penalty rule most ircds use against floods:
+// every line moves a timer forward by its cost and we may send
+// as long as the timer is at most Burst ahead of now
+type throttle struct {
+	lineCost time.Duration
+	byteCost time.Duration
+	burst    time.Duration
+	timer    time.Time
+}
+
+// wait charges the line and returns how long to wait before the next one
+func (t *throttle) wait(line string) time.Duration {
+	now := time.Now()
+	if t.timer.Before(now) {
+		t.timer = now
+	}
+	t.timer = t.timer.Add(t.lineCost + time.Duration(len(line))*t.byteCost)
+	return t.timer.Sub(now) - t.burst
+}
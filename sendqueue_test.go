@@ -0,0 +1,78 @@
+package kitty
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottleWait(t *testing.T) {
+	// Typical ircd rules, 2s a line and 10s of burst
+	th := &throttle{lineCost: 2 * time.Second, burst: 10 * time.Second}
+	for i := 0; i < 5; i++ {
+		if wait := th.wait("PRIVMSG #test :hi"); wait > 0 {
+			t.Fatalf("line %d waits %v inside the burst", i, wait)
+		}
+	}
+	if wait := th.wait("PRIVMSG #test :hi"); wait <= time.Second || wait > 2*time.Second {
+		t.Fatalf("line after the burst waits %v, want about 2s", wait)
+	}
+
+	// Long lines cost more
+	th = &throttle{byteCost: time.Second / 120}
+	if wait := th.wait(strings.Repeat("x", 120)); wait <= 900*time.Millisecond || wait > time.Second {
+		t.Fatalf("120 bytes wait %v, want about 1s", wait)
+	}
+
+	// Time spent idle pays off the penalty
+	th = &throttle{lineCost: time.Second, timer: time.Now().Add(-time.Hour)}
+	if wait := th.wait("PING :x"); wait <= 900*time.Millisecond || wait > time.Second {
+		t.Fatalf("line after a pause waits %v, want about 1s", wait)
+	}
+}
+
+func TestLane(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	for line, priority := range map[string]bool{
+		"PONG :irc.test":    true,
+		"pong :irc.test":    true,
+		"CAP END":           true,
+		"AUTHENTICATE +":    true,
+		"NICK kitty":        true,
+		"PRIVMSG #test :hi": false,
+		"PONGS #test":       false,
+		"JOIN #test":        false,
+		"QUIT :bye":         false,
+	} {
+		if got := bot.lane(line) == bot.priority; got != priority {
+			t.Errorf("%q: priority %v, want %v", line, got, priority)
+		}
+	}
+}
+
+func TestPriorityLane(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv, func(bot *Bot) {
+		bot.ThrottleDelay = 100 * time.Millisecond
+	})
+	for _, text := range []string{"a", "b", "c"} {
+		bot.Send("PRIVMSG #test :" + text)
+	}
+	bot.Send("PONG :irc.test")
+	if _, err := c.Expect(2*time.Second, `^PRIVMSG #test :c$`); err != nil {
+		t.Fatal(err)
+	}
+	pong, b := -1, -1
+	for i, line := range c.Lines() {
+		switch line {
+		case "PONG :irc.test", "PONG irc.test":
+			pong = i
+		case "PRIVMSG #test :b":
+			b = i
+		}
+	}
+	// At most one message was already on its way
+	if pong < 0 || pong > b {
+		t.Fatalf("PONG didn't skip the queue: %q", c.Lines())
+	}
+}
@@ -0,0 +1,561 @@
+package kitty
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State tracks the channels the bot is on and the users it can see.
+// It is fed from the incoming message stream and is safe for concurrent use
+type State struct {
+	mu       sync.RWMutex
+	channels map[string]*channelState
+	users    map[string]*userState
+	// Casemapping aware lowercasing for map keys
+	fold func(string) string
+}
+
+type channelState struct {
+	name      string
+	topic     string
+	topicBy   string
+	topicTime time.Time
+	modes     map[rune]string
+	members   map[string]*member
+	// Set after 366, the next 353 starts a fresh member list
+	namesDone bool
+}
+
+type member struct {
+	user     *userState
+	prefixes string
+}
+
+type userState struct {
+	nick     string
+	user     string
+	host     string
+	realname string
+	account  string
+	away     bool
+	awayMsg  string
+	channels map[string]*channelState
+}
+
+// ChannelState is a snapshot of a channel the bot is on
+type ChannelState struct {
+	Name      string
+	Topic     string
+	TopicBy   string
+	TopicTime time.Time
+	// Channel modes and their parameters, list modes are not tracked
+	Modes map[rune]string
+	// Members maps nicks to their channel prefixes, for example "@+"
+	Members map[string]string
+}
+
+// UserState is a snapshot of a user that shares a channel with the bot
+type UserState struct {
+	Nick     string
+	User     string
+	Host     string
+	Realname string
+	// Services account, empty if unknown or not logged in
+	Account     string
+	Away        bool
+	AwayMessage string
+	// Channels the user shares with the bot
+	Channels []string
+}
+
+func newState(fold func(string) string) *State {
+	s := &State{fold: fold}
+	s.clear()
+	return s
+}
+
+func (s *State) clear() {
+	s.mu.Lock()
+	s.channels = make(map[string]*channelState)
+	s.users = make(map[string]*userState)
+	s.mu.Unlock()
+}
+
+// State returns the channel and user state tracker
+func (bot *Bot) State() *State {
+	return bot.state
+}
+
+// Channels returns the names of the channels the bot is on
+func (s *State) Channels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.channels))
+	for _, ch := range s.channels {
+		names = append(names, ch.name)
+	}
+	return names
+}
+
+// Channel returns a snapshot of the given channel
+func (s *State) Channel(name string) (ChannelState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ch, ok := s.channels[s.fold(name)]
+	if !ok {
+		return ChannelState{}, false
+	}
+	snap := ChannelState{
+		Name:      ch.name,
+		Topic:     ch.topic,
+		TopicBy:   ch.topicBy,
+		TopicTime: ch.topicTime,
+		Modes:     make(map[rune]string, len(ch.modes)),
+		Members:   make(map[string]string, len(ch.members)),
+	}
+	for mode, param := range ch.modes {
+		snap.Modes[mode] = param
+	}
+	for _, mem := range ch.members {
+		snap.Members[mem.user.nick] = mem.prefixes
+	}
+	return snap, true
+}
+
+// User returns a snapshot of the given user
+func (s *State) User(nick string) (UserState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[s.fold(nick)]
+	if !ok {
+		return UserState{}, false
+	}
+	snap := UserState{
+		Nick:        u.nick,
+		User:        u.user,
+		Host:        u.host,
+		Realname:    u.realname,
+		Account:     u.account,
+		Away:        u.away,
+		AwayMessage: u.awayMsg,
+		Channels:    make([]string, 0, len(u.channels)),
+	}
+	for _, ch := range u.channels {
+		snap.Channels = append(snap.Channels, ch.name)
+	}
+	return snap, true
+}
+
+// IsOn reports whether nick is on the channel
+func (s *State) IsOn(channel, nick string) bool {
+	_, ok := s.Prefixes(channel, nick)
+	return ok
+}
+
+// Prefixes returns the channel prefixes of nick, for example "@+"
+func (s *State) Prefixes(channel, nick string) (prefixes string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ch, ok := s.channels[s.fold(channel)]
+	if !ok {
+		return "", false
+	}
+	mem, ok := ch.members[s.fold(nick)]
+	if !ok {
+		return "", false
+	}
+	return mem.prefixes, true
+}
+
+// Topic returns the topic of the channel
+func (s *State) Topic(channel string) (topic string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ch, ok := s.channels[s.fold(channel)]
+	if !ok {
+		return "", false
+	}
+	return ch.topic, true
+}
+
+// update feeds a message to the state tracker
+func (s *State) update(bot *Bot, m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var nick string
+	if m.Prefix != nil {
+		nick = m.Prefix.Name
+		// Keep user@host and accounts fresh from any message
+		if u, ok := s.users[s.fold(nick)]; ok {
+			if m.Prefix.User != "" {
+				u.user = m.Prefix.User
+			}
+			if m.Prefix.Host != "" {
+				u.host = m.Prefix.Host
+			}
+			if account, ok := m.GetTag("account"); ok {
+				u.account = account
+			}
+		}
+	}
+	self := bot.EqualFold(nick, bot.getNick())
+	_, symbols := bot.isupport.Prefix()
+
+	switch m.Command {
+	case "JOIN":
+		name := m.Param(0)
+		if self {
+			s.removeChannel(name)
+			s.newChannel(name)
+		}
+		ch, ok := s.channels[s.fold(name)]
+		if !ok || m.Prefix == nil {
+			return
+		}
+		u := s.user(nick)
+		u.user = m.Prefix.User
+		u.host = m.Prefix.Host
+		// extended-join
+		if len(m.Params) >= 3 {
+			u.account = account(m.Param(1))
+			u.realname = m.Param(2)
+		}
+		s.join(ch, u, "")
+
+	case "PART":
+		for _, name := range strings.Split(m.Param(0), ",") {
+			s.part(name, nick, self)
+		}
+
+	case "KICK":
+		target := m.Param(1)
+		s.part(m.Param(0), target, bot.EqualFold(target, bot.getNick()))
+
+	case "QUIT":
+		if self {
+			s.channels = make(map[string]*channelState)
+			s.users = make(map[string]*userState)
+			return
+		}
+		if u, ok := s.users[s.fold(nick)]; ok {
+			for _, ch := range u.channels {
+				delete(ch.members, s.fold(nick))
+			}
+			delete(s.users, s.fold(nick))
+		}
+
+	case "NICK":
+		newNick := m.Param(0)
+		u, ok := s.users[s.fold(nick)]
+		if !ok {
+			return
+		}
+		delete(s.users, s.fold(nick))
+		u.nick = newNick
+		s.users[s.fold(newNick)] = u
+		for _, ch := range u.channels {
+			mem := ch.members[s.fold(nick)]
+			delete(ch.members, s.fold(nick))
+			ch.members[s.fold(newNick)] = mem
+		}
+
+	case "MODE":
+		ch, ok := s.channels[s.fold(m.Param(0))]
+		if !ok || len(m.Params) < 2 {
+			return
+		}
+		s.mode(bot.isupport, ch, m.Param(1), m.Params[2:])
+
+	case "TOPIC":
+		if ch, ok := s.channels[s.fold(m.Param(0))]; ok {
+			ch.topic = m.Param(1)
+			ch.topicBy = nick
+			ch.topicTime = m.TimeStamp
+		}
+
+	// RPL_CHANNELMODEIS
+	case "324":
+		ch, ok := s.channels[s.fold(m.Param(1))]
+		if !ok || len(m.Params) < 3 {
+			return
+		}
+		ch.modes = make(map[rune]string)
+		s.mode(bot.isupport, ch, m.Param(2), m.Params[3:])
+
+	// RPL_NOTOPIC
+	case "331":
+		if ch, ok := s.channels[s.fold(m.Param(1))]; ok {
+			ch.topic = ""
+			ch.topicBy = ""
+			ch.topicTime = time.Time{}
+		}
+
+	// RPL_TOPIC
+	case "332":
+		if ch, ok := s.channels[s.fold(m.Param(1))]; ok {
+			ch.topic = m.Param(2)
+		}
+
+	// RPL_TOPICWHOTIME
+	case "333":
+		if ch, ok := s.channels[s.fold(m.Param(1))]; ok {
+			setter := m.Param(2)
+			if i := strings.IndexByte(setter, '!'); i >= 0 {
+				setter = setter[:i]
+			}
+			ch.topicBy = setter
+			if ts, err := strconv.ParseInt(m.Param(3), 10, 64); err == nil {
+				ch.topicTime = time.Unix(ts, 0)
+			}
+		}
+
+	// RPL_NAMREPLY
+	case "353":
+		ch, ok := s.channels[s.fold(m.Param(2))]
+		if !ok {
+			return
+		}
+		if ch.namesDone {
+			for key, mem := range ch.members {
+				delete(mem.user.channels, s.fold(ch.name))
+				delete(ch.members, key)
+			}
+			ch.namesDone = false
+		}
+		for _, entry := range strings.Fields(m.Param(3)) {
+			name := strings.TrimLeft(entry, symbols)
+			prefixes := entry[:len(entry)-len(name)]
+			// userhost-in-names
+			var user, host string
+			if i := strings.IndexByte(name, '!'); i >= 0 {
+				user = name[i+1:]
+				name = name[:i]
+				if j := strings.IndexByte(user, '@'); j >= 0 {
+					host = user[j+1:]
+					user = user[:j]
+				}
+			}
+			u := s.user(name)
+			if user != "" {
+				u.user = user
+			}
+			if host != "" {
+				u.host = host
+			}
+			s.join(ch, u, prefixes)
+		}
+		s.purge()
+
+	// RPL_ENDOFNAMES
+	case "366":
+		if ch, ok := s.channels[s.fold(m.Param(1))]; ok {
+			ch.namesDone = true
+		}
+
+	// RPL_WHOREPLY
+	case "352":
+		u, ok := s.users[s.fold(m.Param(5))]
+		if !ok {
+			return
+		}
+		u.user = m.Param(2)
+		u.host = m.Param(3)
+		flags := m.Param(6)
+		u.away = strings.HasPrefix(flags, "G")
+		if hops := strings.SplitN(m.Param(7), " ", 2); len(hops) == 2 {
+			u.realname = hops[1]
+		}
+		if ch, ok := s.channels[s.fold(m.Param(1))]; ok {
+			if mem, ok := ch.members[s.fold(u.nick)]; ok {
+				var prefixes []byte
+				for i := 0; i < len(flags); i++ {
+					if strings.IndexByte(symbols, flags[i]) >= 0 {
+						prefixes = append(prefixes, flags[i])
+					}
+				}
+				mem.prefixes = string(prefixes)
+			}
+		}
+
+	// account-notify
+	case "ACCOUNT":
+		if u, ok := s.users[s.fold(nick)]; ok {
+			u.account = account(m.Param(0))
+		}
+
+	// away-notify
+	case "AWAY":
+		if u, ok := s.users[s.fold(nick)]; ok {
+			u.away = len(m.Params) > 0
+			u.awayMsg = m.Param(0)
+		}
+
+	// chghost
+	case "CHGHOST":
+		if u, ok := s.users[s.fold(nick)]; ok {
+			u.user = m.Param(0)
+			u.host = m.Param(1)
+		}
+
+	// setname
+	case "SETNAME":
+		if u, ok := s.users[s.fold(nick)]; ok {
+			u.realname = m.Param(0)
+		}
+	}
+}
+
+// "*" means not logged in
+func account(name string) string {
+	if name == "*" {
+		return ""
+	}
+	return name
+}
+
+// user returns the tracked user, creating it if needed
+func (s *State) user(nick string) *userState {
+	u, ok := s.users[s.fold(nick)]
+	if !ok {
+		u = &userState{
+			nick:     nick,
+			channels: make(map[string]*channelState),
+		}
+		s.users[s.fold(nick)] = u
+	}
+	return u
+}
+
+func (s *State) join(ch *channelState, u *userState, prefixes string) {
+	ch.members[s.fold(u.nick)] = &member{user: u, prefixes: prefixes}
+	u.channels[s.fold(ch.name)] = ch
+}
+
+func (s *State) part(name, nick string, self bool) {
+	if self {
+		s.removeChannel(name)
+		return
+	}
+	ch, ok := s.channels[s.fold(name)]
+	if !ok {
+		return
+	}
+	if mem, ok := ch.members[s.fold(nick)]; ok {
+		delete(mem.user.channels, s.fold(name))
+		delete(ch.members, s.fold(nick))
+	}
+	s.purge()
+}
+
+func (s *State) newChannel(name string) {
+	s.channels[s.fold(name)] = &channelState{
+		name:    name,
+		modes:   make(map[rune]string),
+		members: make(map[string]*member),
+	}
+}
+
+// addChannel starts tracking a channel we are already on
+func (s *State) addChannel(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[s.fold(name)]; !ok {
+		s.newChannel(name)
+	}
+}
+
+func (s *State) removeChannel(name string) {
+	ch, ok := s.channels[s.fold(name)]
+	if !ok {
+		return
+	}
+	for _, mem := range ch.members {
+		delete(mem.user.channels, s.fold(name))
+	}
+	delete(s.channels, s.fold(name))
+	s.purge()
+}
+
+// purge forgets users we don't share any channels with
+func (s *State) purge() {
+	for key, u := range s.users {
+		if len(u.channels) == 0 {
+			delete(s.users, key)
+		}
+	}
+}
+
+// mode applies a channel mode change
+func (s *State) mode(is *ISupport, ch *channelState, modes string, params []string) {
+	prefixModes, symbols := is.Prefix()
+	typeA, typeB, typeC, _ := is.ChanModes()
+	next := func() string {
+		if len(params) == 0 {
+			return ""
+		}
+		p := params[0]
+		params = params[1:]
+		return p
+	}
+	adding := true
+	for _, mode := range modes {
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.ContainsRune(prefixModes, mode):
+			nick := next()
+			mem, ok := ch.members[s.fold(nick)]
+			if !ok {
+				continue
+			}
+			symbol := symbols[strings.IndexRune(prefixModes, mode)]
+			mem.prefixes = setPrefix(symbols, mem.prefixes, symbol, adding)
+		// Type A, list modes
+		case strings.ContainsRune(typeA, mode):
+			next()
+		// Type B, always has a parameter
+		case strings.ContainsRune(typeB, mode):
+			param := next()
+			if adding {
+				ch.modes[mode] = param
+			} else {
+				delete(ch.modes, mode)
+			}
+		// Type C, has a parameter when set
+		case strings.ContainsRune(typeC, mode):
+			if adding {
+				ch.modes[mode] = next()
+			} else {
+				delete(ch.modes, mode)
+			}
+		// Type D and unknown modes, no parameter
+		default:
+			if adding {
+				ch.modes[mode] = ""
+			} else {
+				delete(ch.modes, mode)
+			}
+		}
+	}
+}
+
+// setPrefix adds or removes a prefix symbol keeping them sorted by rank
+func setPrefix(symbols, prefixes string, symbol byte, add bool) string {
+	var out []byte
+	for i := 0; i < len(symbols); i++ {
+		sym := symbols[i]
+		has := strings.IndexByte(prefixes, sym) >= 0
+		if sym == symbol {
+			has = add
+		}
+		if has {
+			out = append(out, sym)
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,136 @@
+package kitty
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ugjka/kittybot/kittytest"
+)
+
+// feed sends lines from the server and waits until the bot has read them
+func feed(t *testing.T, c *kittytest.Client, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		c.Send(line)
+	}
+	// The state is updated before the PING is answered
+	token := "sync" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	c.Send("PING :" + token)
+	if _, err := c.Expect(time.Second, `^PONG :?`+token+`$`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestState(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	s := bot.State()
+	bot.Join("#cats")
+	waitFor(t, "join", func() bool { return s.IsOn("#cats", "kittybot") })
+	feed(t, c,
+		":alice!a@alice.host JOIN #cats",
+		":bob!b@bob.host JOIN #cats * :Bob Cat",
+	)
+	if p, _ := s.Prefixes("#cats", "kittybot"); p != "@" {
+		t.Fatalf("kittybot has %q, want @", p)
+	}
+	// Nicks fold with rfc1459
+	if !s.IsOn("#Cats", "ALICE") || !s.IsOn("#cats", "bob") {
+		t.Fatal("alice or bob not on #cats")
+	}
+	if u, _ := s.User("bob"); u.Host != "bob.host" || u.Realname != "Bob Cat" || u.Account != "" {
+		t.Fatalf("bob is %+v", u)
+	}
+
+	feed(t, c, ":kittybot!kittybot@kittytest MODE #cats +ov+lk-n alice bob 10 secret")
+	if p, _ := s.Prefixes("#cats", "alice"); p != "@" {
+		t.Fatalf("alice has %q, want @", p)
+	}
+	if p, _ := s.Prefixes("#cats", "bob"); p != "+" {
+		t.Fatalf("bob has %q, want +", p)
+	}
+	ch, _ := s.Channel("#cats")
+	if ch.Modes['l'] != "10" || ch.Modes['k'] != "secret" || len(ch.Modes) != 2 {
+		t.Fatalf("modes are %v", ch.Modes)
+	}
+	feed(t, c, ":alice!a@alice.host MODE #cats +v-lk alice secret")
+	if p, _ := s.Prefixes("#cats", "alice"); p != "@+" {
+		t.Fatalf("alice has %q, want @+", p)
+	}
+	if ch, _ := s.Channel("#cats"); len(ch.Modes) != 0 {
+		t.Fatalf("modes are %v", ch.Modes)
+	}
+
+	feed(t, c, ":alice!a@alice.host NICK alicia")
+	if s.IsOn("#cats", "alice") {
+		t.Fatal("alice still on #cats")
+	}
+	if p, _ := s.Prefixes("#cats", "alicia"); p != "@+" {
+		t.Fatalf("alicia has %q, want @+", p)
+	}
+	if u, ok := s.User("alicia"); !ok || u.Nick != "alicia" || u.Host != "alice.host" {
+		t.Fatalf("alicia is %+v", u)
+	}
+
+	feed(t, c, ":alicia!a@alice.host KICK #cats bob :bye")
+	if s.IsOn("#cats", "bob") {
+		t.Fatal("bob still on #cats")
+	}
+	// Users that share no channel are forgotten
+	if _, ok := s.User("bob"); ok {
+		t.Fatal("bob still tracked")
+	}
+	feed(t, c, ":alicia!a@alice.host PART #cats :later")
+	if s.IsOn("#cats", "alicia") {
+		t.Fatal("alicia still on #cats")
+	}
+
+	feed(t, c, ":carol!c@carol.host JOIN #cats", ":alicia!a@alice.host KICK #cats kittybot")
+	if _, ok := s.Channel("#cats"); ok {
+		t.Fatal("still on #cats after a kick")
+	}
+	if _, ok := s.User("carol"); ok {
+		t.Fatal("carol still tracked")
+	}
+}
+
+func TestStateNames(t *testing.T) {
+	srv := newServer(t)
+	bot, c := startBot(t, srv)
+	s := bot.State()
+	bot.Join("#cats")
+	waitFor(t, "join", func() bool { return s.IsOn("#cats", "kittybot") })
+	// Long lists come in several 353s
+	feed(t, c,
+		":irc.test 353 kittybot = #cats :@kittybot +carol",
+		":irc.test 353 kittybot = #cats :dave!d@dave.host",
+		":irc.test 366 kittybot #cats :End of /NAMES list",
+	)
+	want := map[string]string{"kittybot": "@", "carol": "+", "dave": ""}
+	ch, _ := s.Channel("#cats")
+	if len(ch.Members) != len(want) {
+		t.Fatalf("members are %v", ch.Members)
+	}
+	for nick, prefixes := range want {
+		if ch.Members[nick] != prefixes {
+			t.Fatalf("members are %v, want %v", ch.Members, want)
+		}
+	}
+	if u, _ := s.User("dave"); u.User != "d" || u.Host != "dave.host" {
+		t.Fatalf("dave is %+v", u)
+	}
+
+	// A refresh replaces the members
+	feed(t, c,
+		":irc.test 353 kittybot = #cats :@kittybot eve",
+		":irc.test 366 kittybot #cats :End of /NAMES list",
+	)
+	ch, _ = s.Channel("#cats")
+	if len(ch.Members) != 2 || !s.IsOn("#cats", "eve") {
+		t.Fatalf("members are %v", ch.Members)
+	}
+	if _, ok := s.User("carol"); ok {
+		t.Fatal("carol still tracked")
+	}
+}
@@ -0,0 +1,116 @@
+package kitty
+
+import "sync/atomic"
+
+// TriggerID identifies a trigger added to the bot
+type TriggerID uint64
+
+type triggerEntry struct {
+	id       TriggerID
+	name     string
+	handler  Handler
+	disabled int32
+}
+
+func (t *triggerEntry) enabled() bool {
+	return atomic.LoadInt32(&t.disabled) == 0
+}
+
+// triggers returns the current trigger list, it must not be modified
+func (bot *Bot) triggers() []*triggerEntry {
+	list, _ := bot.handlers.Load().([]*triggerEntry)
+	return list
+}
+
+// modifyTriggers replaces the trigger list with a modified copy,
+// so that dispatch never sees a half updated list
+func (bot *Bot) modifyTriggers(modify func([]*triggerEntry) []*triggerEntry) {
+	bot.handlersMu.Lock()
+	defer bot.handlersMu.Unlock()
+	old := bot.triggers()
+	list := make([]*triggerEntry, len(old))
+	copy(list, old)
+	bot.handlers.Store(modify(list))
+}
+
+// AddTrigger adds a trigger to the bot's handlers.
+// It is safe to add triggers while the bot is running
+func (bot *Bot) AddTrigger(h Handler) TriggerID {
+	return bot.AddNamedTrigger("", h)
+}
+
+// AddNamedTrigger adds a trigger under the given name.
+// If a trigger with that name exists it is replaced in place
+// and keeps its id and enabled state
+func (bot *Bot) AddNamedTrigger(name string, h Handler) (id TriggerID) {
+	bot.modifyTriggers(func(list []*triggerEntry) []*triggerEntry {
+		for i, t := range list {
+			if name != "" && t.name == name {
+				id = t.id
+				list[i] = &triggerEntry{
+					id:       t.id,
+					name:     name,
+					handler:  h,
+					disabled: atomic.LoadInt32(&t.disabled),
+				}
+				return list
+			}
+		}
+		bot.lastID++
+		id = bot.lastID
+		return append(list, &triggerEntry{id: id, name: name, handler: h})
+	})
+	return id
+}
+
+// RemoveTrigger removes the trigger, reports whether it existed
+func (bot *Bot) RemoveTrigger(id TriggerID) (removed bool) {
+	bot.modifyTriggers(func(list []*triggerEntry) []*triggerEntry {
+		for i, t := range list {
+			if t.id == id {
+				removed = true
+				return append(list[:i], list[i+1:]...)
+			}
+		}
+		return list
+	})
+	return
+}
+
+// RemoveNamedTrigger removes the trigger with the given name, reports whether it existed
+func (bot *Bot) RemoveNamedTrigger(name string) bool {
+	id, ok := bot.NamedTrigger(name)
+	if !ok {
+		return false
+	}
+	return bot.RemoveTrigger(id)
+}
+
+// NamedTrigger returns the id of the trigger with the given name
+func (bot *Bot) NamedTrigger(name string) (TriggerID, bool) {
+	for _, t := range bot.triggers() {
+		if name != "" && t.name == name {
+			return t.id, true
+		}
+	}
+	return 0, false
+}
+
+// EnableTrigger enables or disables a trigger without removing it,
+// reports whether the trigger exists
+func (bot *Bot) EnableTrigger(id TriggerID, enabled bool) bool {
+	// A replacement copies the flag, it must not miss this change
+	bot.handlersMu.Lock()
+	defer bot.handlersMu.Unlock()
+	for _, t := range bot.triggers() {
+		if t.id == id {
+			var disabled int32
+			if !enabled {
+				disabled = 1
+			}
+			atomic.StoreInt32(&t.disabled, disabled)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package kitty
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTriggers(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	bot.Dispatch = DispatchSerial
+	r := &recorder{}
+	record := func(name string) Handler {
+		return HandlerFunc(func(bot *Bot, m *Message) {
+			r.add(name + " " + m.Content)
+		})
+	}
+	a := bot.AddTrigger(record("a"))
+	b := bot.AddNamedTrigger("b", record("b"))
+	c := bot.AddTrigger(record("c"))
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :1"))
+	if got := r.wait(t, 3); !equal(got, []string{"a 1", "b 1", "c 1"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// A replacement keeps the id, the place in line and the enabled state
+	if !bot.EnableTrigger(b, false) {
+		t.Fatal("b not found")
+	}
+	if id := bot.AddNamedTrigger("b", record("b2")); id != b {
+		t.Fatalf("replacement got id %d, want %d", id, b)
+	}
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :2"))
+	// Handlers are looked up when the message runs
+	r.wait(t, 5)
+	bot.EnableTrigger(b, true)
+	bot.dispatch(privmsg(":alice!a@h PRIVMSG #test :3"))
+	if got := r.wait(t, 8); !equal(got[3:], []string{"a 2", "c 2", "a 3", "b2 3", "c 3"}) {
+		t.Fatalf("got %v", got[3:])
+	}
+
+	if !bot.RemoveTrigger(a) || bot.RemoveTrigger(a) {
+		t.Fatal("a removed twice or not at all")
+	}
+	if !bot.RemoveNamedTrigger("b") || bot.RemoveNamedTrigger("b") {
+		t.Fatal("b removed twice or not at all")
+	}
+	if bot.EnableTrigger(a, true) {
+		t.Fatal("removed trigger enabled")
+	}
+	if _, ok := bot.NamedTrigger("b"); ok {
+		t.Fatal("b still named")
+	}
+	bot.RemoveTrigger(c)
+	if n := len(bot.triggers()); n != 0 {
+		t.Fatalf("%d triggers left", n)
+	}
+}
+
+func TestEnableWhileReplacing(t *testing.T) {
+	bot := NewBot("irc.test:6667", "kittybot")
+	noop := HandlerFunc(func(*Bot, *Message) {})
+	id := bot.AddNamedTrigger("t", noop)
+	for i := 0; i < 200; i++ {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bot.EnableTrigger(id, false)
+		}()
+		go func() {
+			defer wg.Done()
+			bot.AddNamedTrigger("t", noop)
+		}()
+		wg.Wait()
+		if bot.triggers()[0].enabled() {
+			t.Fatalf("round %d: the disabled flag got lost", i)
+		}
+		bot.EnableTrigger(id, true)
+	}
+}